@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/sessions"
+)
+
+var accountNameRe = regexp.MustCompile(`^[0-9A-Za-z_]{3,32}$`)
+
+const (
+	maxNickNameLen = 64
+	minPasswordLen = 6
+	mysqlErrDupKey = 1062
+)
+
+func (r *UserRepo) Insert(u *User) {
+	r.Lock()
+	r.users[u.ID] = u
+	r.byMail[u.Email] = u.ID
+	r.byAccount[u.AccountName] = u.ID
+	r.Unlock()
+}
+
+func (r *UserRepo) Remove(id int) {
+	userStats.invalidate()
+	r.Lock()
+	if u := r.users[id]; u != nil {
+		delete(r.byMail, u.Email)
+		delete(r.byAccount, u.AccountName)
+		delete(r.users, id)
+	}
+	r.Unlock()
+}
+
+// SetDeactivated deactivates or reactivates the account id. Like
+// UpdatePasshash, it replaces the *User.
+func (r *UserRepo) SetDeactivated(ctx context.Context, id int, deactivated bool) {
+	userStats.invalidate()
+	_, err := dbExec(ctx, db, "users.set_deactivated", `UPDATE users SET deactivated_at = IF(?, NOW(), NULL) WHERE id = ?`, deactivated, id)
+	checkErr(err)
+	r.Lock()
+	if u := r.users[id]; u != nil {
+		nu := *u
+		nu.Deactivated = deactivated
+		r.users[id] = &nu
+	}
+	r.Unlock()
+}
+
+func (r *ProfileRepo) Remove(id int) {
+	profileStats.invalidate()
+	r.Lock()
+	delete(r.profiles, id)
+	r.Unlock()
+}
+
+func (fr *FriendRepo) RemoveUser(id int) {
+	friendStats.invalidate()
+	fr.Lock()
+	for other := range fr.friend[id] {
+		delete(fr.friend[other], id)
+	}
+	delete(fr.friend, id)
+	fr.Unlock()
+}
+
+func (cc *EntryCache) RemoveUser(userID int) {
+	entryStats.invalidate()
+	cc.Lock()
+	defer cc.Unlock()
+	recent := make([]Entry, 0, len(cc.Recent))
+	for _, e := range cc.Recent {
+		if e.UserID != userID {
+			recent = append(recent, e)
+		}
+	}
+	cc.Recent = recent
+}
+
+func (cc *CommentCache) RemoveUser(userID int) {
+	commentStats.invalidate()
+	cc.Lock()
+	defer cc.Unlock()
+	recent := make([]Comment, 0, len(cc.Recent))
+	for _, c := range cc.Recent {
+		if c.UserID != userID && c.EntryOwnerID != userID {
+			recent = append(recent, c)
+		}
+	}
+	cc.Recent = recent
+}
+
+type signupForm struct {
+	Page
+	Message     string
+	AccountName string
+	NickName    string
+	Email       string
+}
+
+func (f *signupForm) validate(passwd string) string {
+	switch {
+	case !accountNameRe.MatchString(f.AccountName):
+		return "アカウント名は3〜32文字の半角英数字と_で入力してください"
+	case f.NickName == "" || utf8.RuneCountInString(f.NickName) > maxNickNameLen:
+		return "ニックネームを64文字以内で入力してください"
+	case !strings.Contains(f.Email, "@") || len(f.Email) > 255:
+		return "メールアドレスが正しくありません"
+	case len(passwd) < minPasswordLen:
+		return "パスワードは6文字以上で入力してください"
+	case userRepo.GetByAccount(f.AccountName) != nil:
+		return "そのアカウント名は既に使われています"
+	case userRepo.GetByMail(f.Email) != nil:
+		return "そのメールアドレスは既に登録されています"
+	}
+	return ""
+}
+
+func GetSignup(w http.ResponseWriter, r *http.Request) error {
+	render(w, r, http.StatusOK, "signup.html", &signupForm{})
+	return nil
+}
+
+func PostSignup(w http.ResponseWriter, r *http.Request) error {
+	form := &signupForm{
+		AccountName: strings.TrimSpace(r.FormValue("account_name")),
+		NickName:    strings.TrimSpace(r.FormValue("nick_name")),
+		Email:       strings.TrimSpace(r.FormValue("email")),
+	}
+	passwd := r.FormValue("password")
+	if form.Message = form.validate(passwd); form.Message != "" {
+		render(w, r, http.StatusBadRequest, "signup.html", form)
+		return nil
+	}
+
+	u := &User{AccountName: form.AccountName, NickName: form.NickName, Email: form.Email, passhash: hashPassword(passwd)}
+	tx, err := db.BeginTx(r.Context(), nil)
+	checkErr(err)
+	result, err := dbExec(r.Context(), tx, "users.insert", `INSERT INTO users (account_name, nick_name, email, passhash) VALUES (?,?,?,?)`,
+		u.AccountName, u.NickName, u.Email, u.passhash)
+	if me, ok := err.(*mysql.MySQLError); ok && me.Number == mysqlErrDupKey {
+		tx.Rollback()
+		form.Message = "そのアカウント名またはメールアドレスは既に使われています"
+		render(w, r, http.StatusConflict, "signup.html", form)
+		return nil
+	}
+	if err != nil {
+		tx.Rollback()
+		return Internal(err)
+	}
+	lastID, _ := result.LastInsertId()
+	u.ID = int(lastID)
+	_, err = dbExec(r.Context(), tx, "profiles.insert", `INSERT INTO profiles (user_id, first_name, last_name, sex, birthday, pref) VALUES (?, '', '', '', NULL, '')`, u.ID)
+	if err != nil {
+		tx.Rollback()
+		return Internal(err)
+	}
+	checkErr(tx.Commit())
+
+	userRepo.Insert(u)
+	profileRepo.Update(u.ID, getProfile(r.Context(), u.ID))
+	slog.InfoContext(r.Context(), "signed up", "user_id", u.ID, "account_name", u.AccountName)
+
+	session := getSession(w, r)
+	session.Values["user_id"] = u.ID
+	session.Save(r, w)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
+}
+
+// PostAccountDeactivate hides the current user from everyone else and logs
+// them out everywhere. Nothing is deleted; logging in again reactivates the
+// account.
+func PostAccountDeactivate(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	if ok, _ := verifyPassword(user, r.FormValue("password")); !ok {
+		return Forbidden("パスワードが違います")
+	}
+	userRepo.SetDeactivated(r.Context(), user.ID, true)
+	sessionStore.RevokeUser(r.Context(), user.ID)
+	slog.InfoContext(r.Context(), "account deactivated", "user_id", user.ID, "account_name", user.AccountName)
+
+	session := getSession(w, r)
+	delete(session.Values, "user_id")
+	session.Options = &sessions.Options{MaxAge: -1}
+	session.Save(r, w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
+}
+
+// PostAccountDelete removes the current user together with everything that
+// refers to them, then logs them out.
+func PostAccountDelete(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	if ok, _ := verifyPassword(user, r.FormValue("password")); !ok {
+		return Forbidden("パスワードが違います")
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	checkErr(err)
+	unread, err := deleteNotifications(r.Context(), tx, `user_id = ? OR actor_id = ? OR entry_id IN (SELECT id FROM entries2 WHERE user_id = ?)`, user.ID, user.ID, user.ID)
+	if err == nil {
+		err = reparentReplies(r.Context(), tx, user.ID)
+	}
+	var visited []int
+	if err == nil {
+		visited, err = footprintedUsers(r.Context(), tx, user.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return Internal(err)
+	}
+	for _, q := range []string{
+		`DELETE FROM comments WHERE user_id = ? OR entry_user_id = ?`,
+		`DELETE FROM entry_revisions WHERE entry_id IN (SELECT id FROM entries2 WHERE user_id = ?)`,
+		`DELETE FROM entries2 WHERE user_id = ?`,
+		`DELETE FROM relations WHERE one = ? OR another = ?`,
+		`DELETE FROM friend_list_members WHERE user_id = ? OR list_id IN (SELECT id FROM friend_lists WHERE user_id = ?)`,
+		`DELETE FROM friend_lists WHERE user_id = ?`,
+		`DELETE FROM friend_requests WHERE from_user_id = ? OR to_user_id = ?`,
+		`DELETE FROM blocks WHERE user_id = ? OR blocked_user_id = ?`,
+		`DELETE FROM footprints WHERE user_id = ? OR owner_id = ?`,
+		`DELETE FROM api_tokens WHERE user_id = ?`,
+		`DELETE FROM sessions WHERE user_id = ?`,
+		`DELETE FROM profiles WHERE user_id = ?`,
+		`DELETE FROM salts WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	} {
+		args := []interface{}{user.ID, user.ID}
+		if _, err := dbExec(r.Context(), tx, "account.delete", q, args[:strings.Count(q, "?")]...); err != nil {
+			tx.Rollback()
+			return Internal(err)
+		}
+	}
+	checkErr(tx.Commit())
+
+	notificationRepo.Forget(unread)
+	notificationRepo.RemoveUser(user.ID)
+	commentCache.RemoveUser(user.ID)
+	entryCache.RemoveUser(user.ID)
+	searchIndex.RemoveUser(user.ID)
+	friendRepo.RemoveUser(user.ID)
+	friendListRepo.RemoveUser(user.ID)
+	friendRequestRepo.RemoveUser(user.ID)
+	blockRepo.RemoveUser(user.ID)
+	apiTokenRepo.RemoveUser(user.ID)
+	sessionStore.RemoveUser(user.ID)
+	footPrintCache.Invalidate(user.ID)
+	for _, id := range visited {
+		footPrintCache.Invalidate(id)
+	}
+	profileRepo.Remove(user.ID)
+	userRepo.Remove(user.ID)
+	slog.InfoContext(r.Context(), "account deleted", "user_id", user.ID, "account_name", user.AccountName)
+
+	session := getSession(w, r)
+	delete(session.Values, "user_id")
+	session.Options = &sessions.Options{MaxAge: -1}
+	session.Save(r, w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The JSON API under /api/v1 mirrors the HTML handlers and applies the same
+// permission rules. Requests are authenticated by a personal access token in
+// the Authorization header, or by the session cookie.
+
+const apiPrefix = "/api/"
+
+var (
+	ErrUnauthorized = &HTTPError{Status: http.StatusUnauthorized, Message: "ログインが必要です"}
+	ErrBadRequest   = &HTTPError{Status: http.StatusBadRequest, Message: "リクエストの形式が正しくありません"}
+)
+
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, apiPrefix)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	checkErr(json.NewEncoder(w).Encode(v))
+}
+
+// writeAPIError is handleError for API requests.
+func writeAPIError(w http.ResponseWriter, he *HTTPError) {
+	if he.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	var body struct {
+		Error struct {
+			Status  int    `json:"status"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Status = he.Status
+	body.Error.Message = he.Message
+	writeJSON(w, he.Status, body)
+}
+
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return ErrBadRequest
+	}
+	return nil
+}
+
+// apiAuth returns the user an API request is made by, authenticated by its
+// token or, failing that, its session cookie.
+func apiAuth(w http.ResponseWriter, r *http.Request) (*User, error) {
+	if u := getCurrentUser(w, r); u != nil {
+		return u, nil
+	}
+	return nil, ErrUnauthorized
+}
+
+type userJSON struct {
+	ID          int    `json:"id"`
+	AccountName string `json:"account_name"`
+	NickName    string `json:"nick_name"`
+	Email       string `json:"email,omitempty"`
+}
+
+func toUserJSON(u *User) userJSON {
+	return userJSON{ID: u.ID, AccountName: u.AccountName, NickName: u.NickName}
+}
+
+type profileJSON struct {
+	FirstName string     `json:"first_name"`
+	LastName  string     `json:"last_name"`
+	Sex       string     `json:"sex,omitempty"`
+	Birthday  string     `json:"birthday,omitempty"`
+	Pref      string     `json:"pref,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// toProfileJSON leaves out what profile.html only shows to friends unless
+// full is set.
+func toProfileJSON(p *Profile, full bool) *profileJSON {
+	if p == nil {
+		return nil
+	}
+	pj := &profileJSON{FirstName: p.FirstName, LastName: p.LastName}
+	if full {
+		pj.Sex = p.Sex
+		if p.Birthday.Valid {
+			pj.Birthday = p.Birthday.Time.Format("2006-01-02")
+		}
+		pj.Pref = p.Pref
+		t := p.UpdatedAt
+		pj.UpdatedAt = &t
+	}
+	return pj
+}
+
+type entryJSON struct {
+	ID            int       `json:"id"`
+	User          userJSON  `json:"user"`
+	Private       bool      `json:"private"`
+	Audience      string    `json:"audience"`
+	ListID        int       `json:"list_id,omitempty"`
+	CommentPolicy string    `json:"comment_policy"`
+	Title         string    `json:"title"`
+	Content       string    `json:"content"`
+	CreatedAt     time.Time `json:"created_at"`
+	NumComments   int       `json:"num_comments"`
+}
+
+func toEntryJSON(e Entry) entryJSON {
+	return entryJSON{e.ID, toUserJSON(getUser(e.UserID)), e.Audience != AudiencePublic, e.Audience.String(), e.ListID, e.CommentPolicy.String(), e.Title, e.Content, e.CreatedAt, e.NumComments}
+}
+
+type commentJSON struct {
+	ID        int       `json:"id"`
+	EntryID   int       `json:"entry_id"`
+	ParentID  int       `json:"parent_id,omitempty"`
+	Depth     int       `json:"depth"`
+	User      userJSON  `json:"user"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func toCommentJSON(c Comment) commentJSON {
+	return commentJSON{c.ID, c.EntryID, c.ParentID, c.Depth, toUserJSON(getUser(c.UserID)), c.Comment, c.CreatedAt}
+}
+
+type pageJSON struct {
+	Items interface{} `json:"items"`
+	Prev  string      `json:"prev,omitempty"`
+	Next  string      `json:"next,omitempty"`
+}
+
+func toPageJSON(r *http.Request, items interface{}, p Pager) pageJSON {
+	pj := pageJSON{Items: items}
+	if p.Prev != "" {
+		pj.Prev = r.URL.Path + string(p.Prev)
+	}
+	if p.Next != "" {
+		pj.Next = r.URL.Path + string(p.Next)
+	}
+	return pj
+}
+
+// APIPostToken exchanges an email and password for a token. Scopes default
+// to all of them.
+func APIPostToken(w http.ResponseWriter, r *http.Request) error {
+	var req struct {
+		Email    string    `json:"email"`
+		Password string    `json:"password"`
+		Name     string    `json:"name"`
+		Scopes   *[]string `json:"scopes"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	scopes := allScopes
+	if req.Scopes != nil {
+		scopes = parseScopes(*req.Scopes)
+		if len(scopes) != len(*req.Scopes) || len(scopes) == 0 {
+			return ErrBadRequest
+		}
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !validTokenName(req.Name) {
+		return ErrBadRequest
+	}
+	u, err := checkLogin(w, r, req.Email, req.Password)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return &HTTPError{Status: http.StatusUnauthorized, Message: "ログインに失敗しました"}
+	}
+	token, err := issueAPIToken(r.Context(), u.ID, req.Name, scopes)
+	if err != nil {
+		return Internal(err)
+	}
+	writeJSON(w, http.StatusCreated, struct {
+		Token  string   `json:"token"`
+		Scopes []string `json:"scopes"`
+		User   userJSON `json:"user"`
+	}{token, scopes, toUserJSON(u)})
+	return nil
+}
+
+// APIDeleteToken revokes the token the request is authenticated with.
+func APIDeleteToken(w http.ResponseWriter, r *http.Request) error {
+	t, err := requestToken(r)
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return ErrUnauthorized
+	}
+	revokeAPIToken(r.Context(), *t)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func APIGetMe(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	uj := toUserJSON(user)
+	uj.Email = user.Email
+	// Clients using the session cookie need the CSRF token to make changes.
+	csrf := ""
+	if reqState(r).token == nil {
+		csrf = csrfToken(w, r)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		User       userJSON     `json:"user"`
+		Profile    *profileJSON `json:"profile"`
+		NumFriends int          `json:"num_friends"`
+		CSRFToken  string       `json:"csrf_token,omitempty"`
+	}{uj, toProfileJSON(profileRepo.Get(user.ID), true), friendRepo.Count(user.ID), csrf})
+	return nil
+}
+
+// APIGetUser is GetProfile without the entries, which are listed by
+// APIListEntries. Like GetProfile, it leaves a footprint.
+func APIGetUser(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	owner := userRepo.GetByAccount(mux.Vars(r)["account_name"])
+	if owner == nil || owner.Deactivated {
+		return ErrContentNotFound
+	}
+	full := permitted2(user.ID, owner.ID)
+	uj := toUserJSON(owner)
+	if full {
+		uj.Email = owner.Email
+	}
+	markFootprint(r.Context(), user.ID, owner.ID)
+	writeJSON(w, http.StatusOK, struct {
+		User        userJSON     `json:"user"`
+		Profile     *profileJSON `json:"profile"`
+		FriendState string       `json:"friend_state"`
+	}{uj, toProfileJSON(profileRepo.Get(owner.ID), full), friendState(user.ID, owner.ID)})
+	return nil
+}
+
+func APIListEntries(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	owner := userRepo.GetByAccount(mux.Vars(r)["account_name"])
+	if owner == nil || owner.Deactivated {
+		return ErrContentNotFound
+	}
+	entries, pager := fetchEntries(r.Context(), user.ID, owner, newPageQuery(r, entriesPerPage, true))
+	markFootprint(r.Context(), user.ID, owner.ID)
+	items := make([]entryJSON, len(entries))
+	for i, e := range entries {
+		items[i] = toEntryJSON(e)
+	}
+	writeJSON(w, http.StatusOK, toPageJSON(r, items, pager))
+	return nil
+}
+
+// apiEntry loads the entry named in the URL and checks that user may see it.
+func apiEntry(r *http.Request, user *User) (*Entry, error) {
+	entryID, err := strconv.Atoi(mux.Vars(r)["entry_id"])
+	if err != nil {
+		return nil, ErrContentNotFound
+	}
+	entry := fetchEntry(r.Context(), entryID)
+	if entry == nil {
+		return nil, ErrContentNotFound
+	}
+	if !entry.visibleTo(user.ID) {
+		return nil, ErrPermissionDenied
+	}
+	return entry, nil
+}
+
+func APIGetEntry(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	entry, err := apiEntry(r, user)
+	if err != nil {
+		return err
+	}
+	row := dbQueryRow(r.Context(), db, "comments.count", `SELECT COUNT(*) FROM comments WHERE entry_id = ?`, entry.ID)
+	checkErr(row.Scan(&entry.NumComments))
+	markFootprint(r.Context(), user.ID, entry.UserID)
+	writeJSON(w, http.StatusOK, toEntryJSON(*entry))
+	return nil
+}
+
+func APIPostEntry(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Title         string `json:"title"`
+		Content       string `json:"content"`
+		Private       bool   `json:"private"`
+		Audience      string `json:"audience"`
+		ListID        int    `json:"list_id"`
+		CommentPolicy string `json:"comment_policy"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	if req.Title == "" {
+		req.Title = "タイトルなし"
+	}
+	audience, listID := AudiencePublic, 0
+	if req.Audience != "" {
+		audience, listID, err = parseAudience(user.ID, req.Audience, req.ListID)
+		if err != nil {
+			return err
+		}
+	} else if req.Private {
+		audience = AudienceFriends
+	}
+	policy, err := parseCommentPolicy(req.CommentPolicy)
+	if err != nil {
+		return err
+	}
+	entry := insertEntry(r.Context(), user, req.Title, req.Content, audience, listID, policy)
+	w.Header().Set("Location", apiPrefix+"v1/entries/"+strconv.Itoa(entry.ID))
+	writeJSON(w, http.StatusCreated, toEntryJSON(entry))
+	return nil
+}
+
+func APIListComments(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	entry, err := apiEntry(r, user)
+	if err != nil {
+		return err
+	}
+	comments, pager := fetchComments(r.Context(), entry.ID, newPageQuery(r, commentsPerPage, false))
+	items := make([]commentJSON, len(comments))
+	for i, c := range comments {
+		items[i] = toCommentJSON(c)
+	}
+	writeJSON(w, http.StatusOK, toPageJSON(r, items, pager))
+	return nil
+}
+
+func APIPostComment(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	entry, err := apiEntry(r, user)
+	if err != nil {
+		return err
+	}
+	if err := entry.commentableBy(user.ID); err != nil {
+		return err
+	}
+	var req struct {
+		Comment  string `json:"comment"`
+		ParentID int    `json:"parent_id"`
+	}
+	if err := decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	parent, err := replyParent(r.Context(), *entry, req.ParentID)
+	if err != nil {
+		return err
+	}
+	c := insertComment(r.Context(), *entry, user, req.Comment, parent)
+	writeJSON(w, http.StatusCreated, toCommentJSON(c))
+	return nil
+}
+
+type friendJSON struct {
+	User      userJSON  `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func APIListFriends(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	friends, pager := fetchFriends(r.Context(), user.ID, newPageQuery(r, friendsPerPage, true))
+	items := make([]friendJSON, len(friends))
+	for i, f := range friends {
+		items[i] = friendJSON{toUserJSON(getUser(f.ID)), f.CreatedAt}
+	}
+	writeJSON(w, http.StatusOK, toPageJSON(r, items, pager))
+	return nil
+}
+
+func APIListFriendRequests(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	conv := func(reqs []FriendRequest, incoming bool) []friendJSON {
+		items := make([]friendJSON, len(reqs))
+		for i, fr := range reqs {
+			other := fr.To
+			if incoming {
+				other = fr.From
+			}
+			items[i] = friendJSON{toUserJSON(getUser(other)), fr.CreatedAt}
+		}
+		return items
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Incoming []friendJSON `json:"incoming"`
+		Outgoing []friendJSON `json:"outgoing"`
+	}{conv(friendRequestRepo.Incoming(user.ID), true), conv(friendRequestRepo.Outgoing(user.ID), false)})
+	return nil
+}
+
+// APIPostFriend sends a friend request to the named user, or accepts theirs.
+func APIPostFriend(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	another := userRepo.GetByAccount(mux.Vars(r)["account_name"])
+	if another == nil || another.ID == user.ID {
+		return ErrContentNotFound
+	}
+	if err := requestFriend(r.Context(), user, another); err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, struct {
+		FriendState string `json:"friend_state"`
+	}{friendState(user.ID, another.ID)})
+	return nil
+}
+
+// APIDeleteFriend unfriends the named user, or cancels or declines a pending
+// friend request with them.
+func APIDeleteFriend(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	another := userRepo.GetByAccount(mux.Vars(r)["account_name"])
+	if another == nil {
+		return ErrContentNotFound
+	}
+	switch friendState(user.ID, another.ID) {
+	case FriendStateFriend:
+		if err := unfriend(r.Context(), user.ID, another.ID); err != nil {
+			return Internal(err)
+		}
+	case FriendStateOutgoing:
+		deleteFriendRequest(r.Context(), user.ID, another.ID)
+	case FriendStateIncoming:
+		deleteFriendRequest(r.Context(), another.ID, user.ID)
+	default:
+		return ErrContentNotFound
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type footprintJSON struct {
+	User      userJSON  `json:"user"`
+	Date      string    `json:"date"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func APIListFootprints(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	footprints, pager := footprintPage(r.Context(), user.ID, newPageQuery(r, footprintsPerPage, true))
+	items := make([]footprintJSON, len(footprints))
+	for i, fp := range footprints {
+		items[i] = footprintJSON{toUserJSON(getUser(fp.OwnerID)), fp.CreatedAt.Format("2006-01-02"), fp.UpdatedAt}
+	}
+	writeJSON(w, http.StatusOK, toPageJSON(r, items, pager))
+	return nil
+}
+
+func APINotFound(w http.ResponseWriter, r *http.Request) error {
+	return ErrContentNotFound
+}
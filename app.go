@@ -2,39 +2,37 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
-	"errors"
 	"fmt"
 	"html/template"
-	"log"
-	"net"
+	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
-	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 )
 
-const UnixPath = "/tmp/isuxi-app.sock"
-
-var (
-	db    *sql.DB
-	store *sessions.CookieStore
-)
+var db *sql.DB
 
 type User struct {
 	ID          int
 	AccountName string
 	NickName    string
 	Email       string
+	passhash    string
+	salt        string
+	// Deactivated users are hidden from everyone else until they log in
+	// again.
+	Deactivated bool
 }
 
 type UserRepo struct {
@@ -44,23 +42,22 @@ type UserRepo struct {
 	byAccount map[string]int
 }
 
-func (r *UserRepo) Init() {
+func (r *UserRepo) Init(ctx context.Context) {
+	userStats.invalidate()
 	r.Lock()
 	defer r.Unlock()
 
 	r.users = make(map[int]*User, 1024)
 	r.byMail = make(map[string]int, 1024)
 	r.byAccount = make(map[string]int, 1024)
-	rows, err := db.Query(`SELECT id, account_name, nick_name, email FROM users`)
-	if err != nil && err != sql.ErrNoRows {
-		log.Fatal(err)
+	rows, err := dbQuery(ctx, db, "users.init", `SELECT u.id, u.account_name, u.nick_name, u.email, u.passhash, IFNULL(s.salt, ''), u.deactivated_at IS NOT NULL
+FROM users u LEFT JOIN salts s ON s.user_id = u.id`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
 	}
 	for rows.Next() {
 		var u User
-		err = rows.Scan(&u.ID, &u.AccountName, &u.NickName, &u.Email)
-		if err != nil {
-			log.Fatal(err)
-		}
+		checkErr(rows.Scan(&u.ID, &u.AccountName, &u.NickName, &u.Email, &u.passhash, &u.salt, &u.Deactivated))
 		r.users[u.ID] = &u
 		r.byMail[u.Email] = u.ID
 		r.byAccount[u.AccountName] = u.ID
@@ -72,6 +69,7 @@ func (r *UserRepo) Get(id int) *User {
 	r.RLock()
 	u := r.users[id]
 	r.RUnlock()
+	userStats.lookup(u != nil)
 	return u
 }
 
@@ -83,6 +81,7 @@ func (r *UserRepo) GetByMail(email string) *User {
 		u = r.users[uid]
 	}
 	r.RUnlock()
+	userStats.lookup(u != nil)
 	return u
 }
 
@@ -94,9 +93,25 @@ func (r *UserRepo) GetByAccount(account string) *User {
 		u = r.users[uid]
 	}
 	r.RUnlock()
+	userStats.lookup(u != nil)
 	return u
 }
 
+// UpdatePasshash stores a new password hash. The *User is replaced rather than
+// modified because callers read it without holding the lock.
+func (r *UserRepo) UpdatePasshash(ctx context.Context, id int, passhash string) {
+	userStats.invalidate()
+	_, err := dbExec(ctx, db, "users.update_passhash", `UPDATE users SET passhash = ? WHERE id = ?`, passhash, id)
+	checkErr(err)
+	r.Lock()
+	if u := r.users[id]; u != nil {
+		nu := *u
+		nu.passhash = passhash
+		r.users[id] = &nu
+	}
+	r.Unlock()
+}
+
 var userRepo = UserRepo{}
 
 type Profile struct {
@@ -117,21 +132,25 @@ type ProfileRepo struct {
 func (r *ProfileRepo) Get(id int) *Profile {
 	r.Lock()
 	defer r.Unlock()
-	return r.profiles[id]
+	prof := r.profiles[id]
+	profileStats.lookup(prof != nil)
+	return prof
 }
 
 func (r *ProfileRepo) Update(id int, prof *Profile) {
+	profileStats.invalidate()
 	r.Lock()
 	defer r.Unlock()
 	r.profiles[id] = prof
 }
 
-func (r *ProfileRepo) Init() {
+func (r *ProfileRepo) Init(ctx context.Context) {
+	profileStats.invalidate()
 	r.Lock()
 	defer r.Unlock()
 	r.profiles = make(map[int]*Profile, 1000)
 
-	rows, err := db.Query(`SELECT * FROM profiles`)
+	rows, err := dbQuery(ctx, db, "profiles.init", `SELECT * FROM profiles`)
 	if err != nil {
 		panic(err)
 	}
@@ -149,18 +168,21 @@ func (r *ProfileRepo) Init() {
 var profileRepo = &ProfileRepo{}
 
 type Entry struct {
-	ID          int
-	UserID      int
-	Private     bool
-	Title       string
-	Content     string
-	CreatedAt   time.Time
-	NumComments int
+	ID            int
+	UserID        int
+	Audience      Audience
+	ListID        int
+	CommentPolicy CommentPolicy
+	Title         string
+	Content       string
+	CreatedAt     time.Time
+	NumComments   int
 }
 
 type Friend struct {
-	ID        int
-	CreatedAt time.Time
+	ID         int
+	CreatedAt  time.Time
+	relationID int
 }
 
 type FriendRepo struct {
@@ -171,6 +193,7 @@ type FriendRepo struct {
 var friendRepo = FriendRepo{friend: make(map[int]map[int]bool, 1024)}
 
 func (fr *FriendRepo) Reset() {
+	friendStats.invalidate()
 	fr.Lock()
 	fr.friend = make(map[int]map[int]bool, 1024)
 	fr.Unlock()
@@ -196,17 +219,23 @@ func (fr *FriendRepo) Insert(a, b int) {
 	fr.Unlock()
 }
 
+func (fr *FriendRepo) Remove(a, b int) {
+	friendStats.invalidate()
+	fr.Lock()
+	delete(fr.friend[a], b)
+	delete(fr.friend[b], a)
+	fr.Unlock()
+}
+
 func (fr *FriendRepo) IsFriend(a, b int) bool {
 	if a == b {
 		return true
 	}
 	fr.Lock()
-	defer fr.Unlock()
-	aa := fr.friend[a]
-	if aa == nil {
-		return false
-	}
-	return aa[b]
+	found := fr.friend[a][b]
+	fr.Unlock()
+	friendStats.lookup(found)
+	return found
 }
 
 func (fr *FriendRepo) Count(userID int) int {
@@ -217,12 +246,43 @@ func (fr *FriendRepo) Count(userID int) int {
 		c = len(m)
 	}
 	fr.Unlock()
+	friendStats.lookup(m != nil)
 	return c
 }
 
-func (fr *FriendRepo) Init() {
+// HasMutual reports whether a and b have a friend in common.
+func (fr *FriendRepo) HasMutual(a, b int) bool {
+	fr.Lock()
+	defer fr.Unlock()
+	fa, fb := fr.friend[a], fr.friend[b]
+	if len(fa) > len(fb) {
+		fa, fb = fb, fa
+	}
+	for id := range fa {
+		if fb[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// FriendIDs returns userID's friends in ID order.
+func (fr *FriendRepo) FriendIDs(userID int) []int {
+	fr.Lock()
+	m := fr.friend[userID]
+	ids := make([]int, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	fr.Unlock()
+	friendStats.lookup(m != nil)
+	sort.Ints(ids)
+	return ids
+}
+
+func (fr *FriendRepo) Init(ctx context.Context) {
 	fr.Reset()
-	rows, err := db.Query(`SELECT one, another FROM relations`)
+	rows, err := dbQuery(ctx, db, "relations.init", `SELECT one, another FROM relations`)
 	if err != sql.ErrNoRows && err != nil {
 		panic(err)
 	}
@@ -241,7 +301,12 @@ type Comment struct {
 	Comment      string
 	CreatedAt    time.Time
 	EntryOwnerID int
-	private      bool
+	ParentID     int // the comment replied to, or 0
+	RootID       int // the top-level comment of the thread, or 0 for one
+	Depth        int
+	// Copied from the entry, for filtering the cached comments.
+	entryAudience Audience
+	entryListID   int
 }
 
 type CommentCache struct {
@@ -251,10 +316,11 @@ type CommentCache struct {
 
 var commentCache CommentCache
 
-func (cc *CommentCache) Init() {
+func (cc *CommentCache) Init(ctx context.Context) {
+	commentStats.invalidate()
 	cc.Lock()
 	defer cc.Unlock()
-	rows, err := db.Query(`SELECT c.id, entry_id, c.user_id, comment, c.created_at, e.user_id, e.private
+	rows, err := dbQuery(ctx, db, "comments.init", `SELECT c.id, entry_id, c.user_id, comment, c.created_at, e.user_id, e.private, e.list_id
 FROM comments as c LEFT JOIN entries2 as e ON (entry_id=e.id) ORDER BY c.created_at DESC LIMIT 1000`)
 	if err != nil {
 		panic(err)
@@ -263,7 +329,7 @@ FROM comments as c LEFT JOIN entries2 as e ON (entry_id=e.id) ORDER BY c.created
 	cc.Recent = make([]Comment, 0, 1000)
 	for rows.Next() {
 		c := Comment{}
-		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt, &c.EntryOwnerID, &c.private))
+		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt, &c.EntryOwnerID, &c.entryAudience, &c.entryListID))
 		cc.Recent = append(cc.Recent, c)
 	}
 	for i := 0; i < len(cc.Recent)/2; i++ {
@@ -281,6 +347,53 @@ func (cc *CommentCache) Insert(c Comment) {
 	}
 }
 
+// SetEntryAudience updates the audience copied from an entry into its
+// comments. Like EntryCache.Update, it works on a copy of Recent.
+func (cc *CommentCache) SetEntryAudience(entryID int, a Audience, listID int) {
+	commentStats.invalidate()
+	cc.Lock()
+	defer cc.Unlock()
+	recent := make([]Comment, len(cc.Recent))
+	copy(recent, cc.Recent)
+	for i := range recent {
+		if recent[i].EntryID == entryID {
+			recent[i].entryAudience = a
+			recent[i].entryListID = listID
+		}
+	}
+	cc.Recent = recent
+}
+
+func (cc *CommentCache) RemoveEntry(entryID int) {
+	commentStats.invalidate()
+	cc.Lock()
+	defer cc.Unlock()
+	recent := make([]Comment, 0, len(cc.Recent))
+	for _, c := range cc.Recent {
+		if c.EntryID != entryID {
+			recent = append(recent, c)
+		}
+	}
+	cc.Recent = recent
+}
+
+func (cc *CommentCache) Remove(commentIDs ...int) {
+	commentStats.invalidate()
+	removed := make(map[int]bool, len(commentIDs))
+	for _, id := range commentIDs {
+		removed[id] = true
+	}
+	cc.Lock()
+	defer cc.Unlock()
+	recent := make([]Comment, 0, len(cc.Recent))
+	for _, c := range cc.Recent {
+		if !removed[c.ID] {
+			recent = append(recent, c)
+		}
+	}
+	cc.Recent = recent
+}
+
 func (cc *CommentCache) Get() []Comment {
 	cc.Lock()
 	defer cc.Unlock()
@@ -292,20 +405,19 @@ var prefs = []string{"未入力",
 	"石川県", "福井県", "山梨県", "長野県", "岐阜県", "静岡県", "愛知県", "三重県", "滋賀県", "京都府", "大阪府", "兵庫県", "奈良県", "和歌山県", "鳥取県", "島根県",
 	"岡山県", "広島県", "山口県", "徳島県", "香川県", "愛媛県", "高知県", "福岡県", "佐賀県", "長崎県", "熊本県", "大分県", "宮崎県", "鹿児島県", "沖縄県"}
 
-var (
-	ErrContentNotFound = errors.New("Content not found.")
-)
-
 func authenticationFailed(w http.ResponseWriter, r *http.Request) {
 	session := getSession(w, r)
 	delete(session.Values, "user_id")
 	session.Save(r, w)
-	render(w, r, http.StatusUnauthorized, "login.html", struct{ Message string }{"ログインに失敗しました"})
+	render(w, r, http.StatusUnauthorized, "login.html", &struct {
+		Page
+		Message string
+	}{Message: "ログインに失敗しました"})
 }
 
-func getProfile(id int) *Profile {
+func getProfile(ctx context.Context, id int) *Profile {
 	prof := Profile{}
-	row := db.QueryRow(`SELECT * FROM profiles WHERE user_id = ?`, id)
+	row := dbQueryRow(ctx, db, "profiles.get", `SELECT * FROM profiles WHERE user_id = ?`, id)
 	err := row.Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
 	if err == sql.ErrNoRows {
 		return nil
@@ -316,35 +428,91 @@ func getProfile(id int) *Profile {
 	return &prof
 }
 
-func authenticate(w http.ResponseWriter, r *http.Request, email, passwd string) {
+// checkLogin returns the user with email and passwd, or nil. It returns an
+// error if the attempt is refused by the login throttle.
+func checkLogin(w http.ResponseWriter, r *http.Request, email, passwd string) (*User, error) {
+	key := loginKey(email)
+	if err := throttleLogin(w, r, key); err != nil {
+		return nil, err
+	}
 	u := userRepo.GetByMail(email)
+	if u == nil {
+		verifyPassword(&User{passhash: dummyPasshash}, passwd)
+		loginFailed(r.Context(), clientIP(r), key, 0)
+		return nil, nil
+	}
+	ok, rehash := verifyPassword(u, passwd)
+	if !ok {
+		loginFailed(r.Context(), clientIP(r), key, u.ID)
+		return nil, nil
+	}
+	loginSucceeded(clientIP(r), key)
+	if rehash {
+		userRepo.UpdatePasshash(r.Context(), u.ID, hashPassword(passwd))
+		slog.DebugContext(r.Context(), "password rehashed", "user_id", u.ID)
+	}
+	if u.Deactivated {
+		userRepo.SetDeactivated(r.Context(), u.ID, false)
+		slog.InfoContext(r.Context(), "account reactivated", "user_id", u.ID)
+	}
+	return userRepo.Get(u.ID), nil
+}
+
+func authenticate(w http.ResponseWriter, r *http.Request, email, passwd string) bool {
+	u, err := checkLogin(w, r, email, passwd)
+	if err == ErrLoginLocked {
+		render(w, r, ErrLoginLocked.Status, "login.html", &struct {
+			Page
+			Message string
+		}{Message: ErrLoginLocked.Message})
+		return false
+	}
 	if u == nil {
 		authenticationFailed(w, r)
-		return
+		return false
 	}
 	session := getSession(w, r)
 	session.Values["user_id"] = u.ID
 	session.Save(r, w)
-}
-
-func permissionDenied(w http.ResponseWriter, r *http.Request) {
-	render(w, r, http.StatusForbidden, "error.html", struct{ Message string }{"友人のみしかアクセスできません"})
+	return true
 }
 
 func getCurrentUser(w http.ResponseWriter, r *http.Request) *User {
-	u := context.Get(r, "user")
-	if u != nil {
-		user := u.(*User)
-		return user
+	st := reqState(r)
+	if st.userLoaded {
+		return st.user
+	}
+	if t, err := requestToken(r); t != nil || err != nil {
+		if t != nil {
+			if u := userRepo.Get(t.UserID); u != nil && !u.Deactivated {
+				st.user = u
+			}
+		}
+		st.userLoaded = true
+		return st.user
 	}
 	session := getSession(w, r)
 	userID, ok := session.Values["user_id"]
 	if !ok || userID == nil {
 		return nil
 	}
-	user := userRepo.Get(userID.(int))
-	context.Set(r, "user", user)
-	return user
+	st.user = userRepo.Get(userID.(int))
+	if st.user != nil && st.user.Deactivated {
+		st.user = nil
+	}
+	st.userLoaded = true
+	return st.user
+}
+
+// sessionUserID returns the user ID stored in the session, without looking
+// the user up.
+func sessionUserID(r *http.Request) int {
+	session, err := sessionStore.Get(r, sessionName)
+	if err != nil || session == nil {
+		return 0
+	}
+	id, _ := session.Values["user_id"].(int)
+	return id
 }
 
 func authenticated(w http.ResponseWriter, r *http.Request) bool {
@@ -364,27 +532,6 @@ func getUserFromAccount(w http.ResponseWriter, name string) *User {
 	return userRepo.GetByAccount(name)
 }
 
-func isFriend(w http.ResponseWriter, r *http.Request, anotherID int) bool {
-	session := getSession(w, r)
-	id := session.Values["user_id"].(int)
-	return friendRepo.IsFriend(id, anotherID)
-}
-
-func isFriendAccount(w http.ResponseWriter, r *http.Request, name string) bool {
-	user := userRepo.GetByAccount(name)
-	if user == nil {
-		return false
-	}
-	return isFriend(w, r, user.ID)
-}
-
-func permitted(w http.ResponseWriter, r *http.Request, anotherID int) bool {
-	user := getCurrentUser(w, r)
-	if anotherID == user.ID {
-		return true
-	}
-	return isFriend(w, r, anotherID)
-}
 func permitted2(myID, anotherID int) bool {
 	if myID == anotherID {
 		return true
@@ -393,12 +540,12 @@ func permitted2(myID, anotherID int) bool {
 }
 
 func getSession(w http.ResponseWriter, r *http.Request) *sessions.Session {
-	session, _ := store.Get(r, "isucon5q-go.session")
+	session, _ := sessionStore.Get(r, sessionName)
 	return session
 }
 
 func getTemplatePath(file string) string {
-	return path.Join("templates", file)
+	return path.Join(config.TemplateDir, file)
 }
 
 var templates map[string]*template.Template
@@ -408,7 +555,7 @@ func initTemplate(t string, fm template.FuncMap) {
 	templates[t] = tpl
 }
 
-func init() {
+func initTemplates() {
 	templates = make(map[string]*template.Template)
 	fmap := template.FuncMap{
 		"getUser": getUser,
@@ -421,10 +568,14 @@ func init() {
 			}
 			return s
 		},
-		"split": strings.Split,
+		"split":    strings.Split,
+		"mentions": mentionHTML,
+		"scopeLabel": func(s string) string {
+			return scopeLabels[s]
+		},
 	}
 
-	templates_str := "entries.html entry.html error.html footprints.html friends.html index.html login.html profile.html"
+	templates_str := "entries.html entry.html error.html footprints.html friends.html index.html login.html profile.html signup.html friend_requests.html blocks.html revisions.html tokens.html sessions.html friend_lists.html notifications.html search.html"
 	templates := strings.Split(templates_str, " ")
 	for _, t := range templates {
 		initTemplate(t, fmap)
@@ -433,39 +584,57 @@ func init() {
 
 func render(w http.ResponseWriter, r *http.Request, status int, file string, data interface{}) {
 	tpl := templates[file]
+	// Sessions can't be read until the DB is up, so pages rendered while
+	// warming up leave Page empty.
+	if p, ok := data.(pageSetter); ok && isReady() {
+		pg := Page{CSRFToken: csrfToken(w, r)}
+		if user := getCurrentUser(w, r); user != nil {
+			pg.Viewer = user
+			pg.Unread = notificationRepo.Unread(user.ID)
+		}
+		p.setPage(pg)
+	}
 	w.WriteHeader(status)
 	checkErr(tpl.Execute(w, data))
 }
 
-func GetLogin(w http.ResponseWriter, r *http.Request) {
-	render(w, r, http.StatusOK, "login.html", struct{ Message string }{"高負荷に耐えられるSNSコミュニティサイトへようこそ!"})
+func GetLogin(w http.ResponseWriter, r *http.Request) error {
+	render(w, r, http.StatusOK, "login.html", &struct {
+		Page
+		Message string
+	}{Message: "高負荷に耐えられるSNSコミュニティサイトへようこそ!"})
+	return nil
 }
 
-func PostLogin(w http.ResponseWriter, r *http.Request) {
+func PostLogin(w http.ResponseWriter, r *http.Request) error {
 	email := r.FormValue("email")
 	passwd := r.FormValue("password")
-	authenticate(w, r, email, passwd)
+	if !authenticate(w, r, email, passwd) {
+		return nil
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
+	return nil
 }
 
-func GetLogout(w http.ResponseWriter, r *http.Request) {
+func GetLogout(w http.ResponseWriter, r *http.Request) error {
 	session := getSession(w, r)
 	delete(session.Values, "user_id")
 	session.Options = &sessions.Options{MaxAge: -1}
 	session.Save(r, w)
 	http.Redirect(w, r, "/login", http.StatusFound)
+	return nil
 }
 
-func GetIndex(w http.ResponseWriter, r *http.Request) {
+func GetIndex(w http.ResponseWriter, r *http.Request) error {
 	user := getCurrentUser(w, r)
 	if user == nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
-		return
+		return nil
 	}
 
 	prof := profileRepo.Get(user.ID)
 
-	rows, err := db.Query(`SELECT id, title FROM entries2 WHERE user_id = ? ORDER BY created_at LIMIT 5`, user.ID)
+	rows, err := dbQuery(r.Context(), db, "entries.index", `SELECT id, title FROM entries2 WHERE user_id = ? ORDER BY created_at LIMIT 5`, user.ID)
 	if err != sql.ErrNoRows {
 		checkErr(err)
 	}
@@ -478,7 +647,7 @@ func GetIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	rows.Close()
 
-	rows, err = db.Query(`SELECT c.id AS id, c.entry_id AS entry_id, c.user_id AS user_id, c.comment AS comment, c.created_at AS created_at
+	rows, err = dbQuery(r.Context(), db, "comments.index", `SELECT c.id AS id, c.entry_id AS entry_id, c.user_id AS user_id, c.comment AS comment, c.created_at AS created_at
 FROM comments c
 WHERE c.entry_user_id = ?
 ORDER BY c.created_at DESC
@@ -498,7 +667,7 @@ LIMIT 10`, user.ID)
 	entriesOfFriends := make([]Entry, 0, 10)
 	for i := len(recentEntries) - 1; i >= 0; i-- {
 		e := recentEntries[i]
-		if !friendRepo.IsFriend(user.ID, e.UserID) {
+		if !friendRepo.IsFriend(user.ID, e.UserID) || blockRepo.Between(user.ID, e.UserID) || !e.visibleTo(user.ID) {
 			continue
 		}
 		entriesOfFriends = append(entriesOfFriends, e)
@@ -506,28 +675,31 @@ LIMIT 10`, user.ID)
 			break
 		}
 	}
+	// Fewer than 10 means older entries, only in the DB, may have been left
+	// out.
+	entryStats.lookup(len(entriesOfFriends) >= 10)
 
 	commentsOfFriends := make([]Comment, 0, 10)
 	cc := commentCache.Get()
 	for i := len(cc) - 1; i >= 0; i-- {
 		c := cc[i]
-		if !friendRepo.IsFriend(user.ID, c.UserID) {
+		if !friendRepo.IsFriend(user.ID, c.UserID) || blockRepo.Between(user.ID, c.EntryOwnerID) {
 			continue
 		}
-		if c.private {
-			if !permitted2(user.ID, c.EntryOwnerID) {
-				continue
-			}
+		if !canView(user.ID, c.EntryOwnerID, c.entryAudience, c.entryListID) {
+			continue
 		}
 		commentsOfFriends = append(commentsOfFriends, c)
 		if len(commentsOfFriends) >= 10 {
 			break
 		}
 	}
+	commentStats.lookup(len(commentsOfFriends) >= 10)
 
-	footprints := footPrintCache.Get(user.ID)[:10]
+	footprints := footPrintCache.Recent(r.Context(), user.ID, 10)
 
-	render(w, r, http.StatusOK, "index.html", struct {
+	render(w, r, http.StatusOK, "index.html", &struct {
+		Page
 		User              User
 		Profile           *Profile
 		Entries           []Entry
@@ -537,65 +709,69 @@ LIMIT 10`, user.ID)
 		NumFriends        int
 		Footprints        []Footprint
 	}{
-		*user, prof, entries, commentsForMe, renderFriendEntries(entriesOfFriends),
+		Page{}, *user, prof, entries, commentsForMe, renderFriendEntries(entriesOfFriends),
 		renderCommentsOfFriends(commentsOfFriends), friendRepo.Count(user.ID), footprints,
 	})
+	return nil
 }
 
-func GetProfile(w http.ResponseWriter, r *http.Request) {
+func GetProfile(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 	currentUser := getCurrentUser(w, r)
 
 	account := mux.Vars(r)["account_name"]
 	owner := getUserFromAccount(w, account)
+	if owner == nil || owner.Deactivated {
+		return ErrContentNotFound
+	}
 	prof := profileRepo.Get(owner.ID)
 
-	var query string
-	if permitted2(currentUser.ID, owner.ID) {
-		query = `SELECT * FROM entries2 WHERE user_id = ? ORDER BY created_at LIMIT 5`
-	} else {
-		query = `SELECT * FROM entries2 WHERE user_id = ? AND private=0 ORDER BY created_at LIMIT 5`
-	}
-	rows, err := db.Query(query, owner.ID)
+	cond, args := audienceFilter(currentUser.ID, owner.ID)
+	query := `SELECT id, user_id, private, list_id, title, body, created_at FROM entries2 WHERE user_id = ?` + cond + ` ORDER BY created_at LIMIT 5`
+	rows, err := dbQuery(r.Context(), db, "entries.profile", query, append([]interface{}{owner.ID}, args...)...)
 	if err != sql.ErrNoRows {
 		checkErr(err)
 	}
 	entries := make([]Entry, 0, 5)
 	for rows.Next() {
-		var id, userID, private int
+		var id, userID, listID int
+		var audience Audience
 		var title, body string
 		var createdAt time.Time
-		checkErr(rows.Scan(&id, &userID, &private, &title, &body, &createdAt))
-		entry := Entry{id, userID, private == 1, title, body, createdAt, 0}
+		checkErr(rows.Scan(&id, &userID, &audience, &listID, &title, &body, &createdAt))
+		entry := Entry{id, userID, audience, listID, 0, title, body, createdAt, 0}
 		entries = append(entries, entry)
 	}
 	rows.Close()
 
-	markFootprint(currentUser.ID, owner.ID)
+	markFootprint(r.Context(), currentUser.ID, owner.ID)
 
-	render(w, r, http.StatusOK, "profile.html", struct {
+	render(w, r, http.StatusOK, "profile.html", &struct {
+		Page
 		Owner       *User
 		Profile     *Profile
 		Entries     []Entry
 		Private     bool
 		CurrentUser *User
-		IsFriend    bool
+		FriendState string
+		Blocked     bool
 	}{
-		owner, prof, entries, permitted2(currentUser.ID, owner.ID), currentUser, isFriend(w, r, owner.ID),
+		Page{}, owner, prof, entries, permitted2(currentUser.ID, owner.ID), currentUser, friendState(currentUser.ID, owner.ID),
+		blockRepo.IsBlocked(currentUser.ID, owner.ID),
 	})
+	return nil
 }
 
-func PostProfile(w http.ResponseWriter, r *http.Request) {
+func PostProfile(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 	user := getCurrentUser(w, r)
 	account := mux.Vars(r)["account_name"]
 	if account != user.AccountName {
-		permissionDenied(w, r)
-		return
+		return ErrPermissionDenied
 	}
 	query := `UPDATE profiles
 SET first_name=?, last_name=?, sex=?, birthday=?, pref=?, updated_at=CURRENT_TIMESTAMP()
@@ -605,11 +781,11 @@ WHERE user_id = ?`
 	lastName := r.FormValue("last_name")
 	sex := r.FormValue("sex")
 	pref := r.FormValue("pref")
-	_, err := db.Exec(query, firstName, lastName, sex, birth, pref, user.ID)
+	_, err := dbExec(r.Context(), db, "profiles.update", query, firstName, lastName, sex, birth, pref, user.ID)
 	checkErr(err)
 
 	prof := Profile{}
-	row := db.QueryRow("SELECT * FROM profiles WHERE user_id=?", user.ID)
+	row := dbQueryRow(r.Context(), db, "profiles.get", "SELECT * FROM profiles WHERE user_id=?", user.ID)
 	err = row.Scan(&prof.UserID, &prof.FirstName, &prof.LastName, &prof.Sex, &prof.Birthday, &prof.Pref, &prof.UpdatedAt)
 	if err != nil {
 		panic(err)
@@ -618,97 +794,182 @@ WHERE user_id = ?`
 	// TODO should escape the account name?
 	profileRepo.Update(user.ID, &prof)
 	http.Redirect(w, r, "/profile/"+account, http.StatusSeeOther)
+	return nil
 }
 
-func ListEntries(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
-	}
-	myID := getCurrentUser(w, r).ID
-
-	account := mux.Vars(r)["account_name"]
-	owner := getUserFromAccount(w, account)
-	var query string
-	const select_expr = `SELECT id, user_id, private, title, body, created_at, (select count(*) FROM comments WHERE entry_id=entries2.id) FROM entries2 `
-	if permitted2(myID, owner.ID) {
-		query = select_expr + `WHERE user_id = ? ORDER BY created_at DESC LIMIT 20`
-	} else {
-		query = select_expr + `WHERE user_id = ? AND private=0 ORDER BY created_at DESC LIMIT 20`
-	}
-	rows, err := db.Query(query, owner.ID)
+const entriesPerPage = 20
+
+// fetchEntries returns a page of owner's entries as seen by viewerID.
+func fetchEntries(ctx context.Context, viewerID int, owner *User, pq pageQuery) ([]Entry, Pager) {
+	const select_expr = `SELECT id, user_id, private, list_id, title, body, created_at, (select count(*) FROM comments WHERE entry_id=entries2.id) FROM entries2 `
+	filter, args := audienceFilter(viewerID, owner.ID)
+	query := select_expr + `WHERE user_id = ?` + filter
+	cond, pageArgs := pq.where("created_at", "id")
+	query += cond + pq.orderLimit("created_at", "id")
+	args = append(append([]interface{}{owner.ID}, args...), pageArgs...)
+	rows, err := dbQuery(ctx, db, "entries.list", query, args...)
 	if err != sql.ErrNoRows {
 		checkErr(err)
 	}
-	entries := make([]Entry, 0, 20)
+	entries := make([]Entry, 0, pq.limit+1)
 	for rows.Next() {
-		var id, userID, private int
+		var id, userID, listID int
+		var audience Audience
 		var title, body string
 		var createdAt time.Time
 		var nc int
-		checkErr(rows.Scan(&id, &userID, &private, &title, &body, &createdAt, &nc))
-		entry := Entry{id, userID, private == 1, title, body, createdAt, nc}
+		checkErr(rows.Scan(&id, &userID, &audience, &listID, &title, &body, &createdAt, &nc))
+		entry := Entry{id, userID, audience, listID, 0, title, body, createdAt, nc}
 		entries = append(entries, entry)
 	}
 	rows.Close()
+	fetched := len(entries)
+	entries = entries[:pq.keep(fetched)]
+	if pq.backward {
+		for i := 0; i < len(entries)/2; i++ {
+			entries[i], entries[len(entries)-1-i] = entries[len(entries)-1-i], entries[i]
+		}
+	}
+	var pager Pager
+	if len(entries) > 0 {
+		first, last := entries[0], entries[len(entries)-1]
+		pager = pq.pager(fetched, Cursor{first.CreatedAt, first.ID}, Cursor{last.CreatedAt, last.ID})
+	}
+	return entries, pager
+}
+
+func ListEntries(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	myID := getCurrentUser(w, r).ID
+
+	account := mux.Vars(r)["account_name"]
+	owner := getUserFromAccount(w, account)
+	if owner == nil || owner.Deactivated {
+		return ErrContentNotFound
+	}
+	entries, pager := fetchEntries(r.Context(), myID, owner, newPageQuery(r, entriesPerPage, true))
 
 	currentUser := getCurrentUser(w, r)
-	markFootprint(currentUser.ID, owner.ID)
+	markFootprint(r.Context(), currentUser.ID, owner.ID)
 
-	render(w, r, http.StatusOK, "entries.html", struct {
+	var lists []FriendList
+	if currentUser.ID == owner.ID {
+		lists = friendListRepo.ListsOf(owner.ID)
+	}
+	render(w, r, http.StatusOK, "entries.html", &struct {
+		Page
 		Owner   *User
 		Myself  bool
 		Entries template.HTML
-	}{owner, currentUser.ID == owner.ID, renderEntriesList(entries)})
+		Pager   Pager
+		Lists   []FriendList
+	}{Page{}, owner, currentUser.ID == owner.ID, renderEntriesList(entries), pager, lists})
+	return nil
 }
 
-func GetEntry(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
-	}
-	entryID := mux.Vars(r)["entry_id"]
-	row := db.QueryRow(`SELECT * FROM entries2 WHERE id = ?`, entryID)
-	var id, userID, private int
-	var title, body string
-	var createdAt time.Time
-	err := row.Scan(&id, &userID, &private, &title, &body, &createdAt)
-	if err == sql.ErrNoRows {
-		render(w, r, http.StatusNotFound, "error.html", struct{ Message string }{"要求されたコンテンツは存在しません"})
-		return
-	}
-	checkErr(err)
-	entry := Entry{id, userID, private == 1, title, body, createdAt, 0}
-	owner := getUser(entry.UserID)
-	if entry.Private {
-		if !permitted(w, r, owner.ID) {
-			permissionDenied(w, r)
-			return
-		}
-	}
-	rows, err := db.Query(`SELECT id, entry_id, user_id, comment, created_at FROM comments WHERE entry_id = ?`, entry.ID)
+const commentsPerPage = 50
+
+// fetchComments returns a page of the threads on an entry, oldest first.
+// Pages are of top-level comments, each followed by all of its replies.
+func fetchComments(ctx context.Context, entryID int, pq pageQuery) ([]Comment, Pager) {
+	cond, args := pq.where("created_at", "id")
+	rows, err := dbQuery(ctx, db, "comments.list", `SELECT `+commentColumns+` FROM comments WHERE entry_id = ? AND parent_id = 0`+cond+pq.orderLimit("created_at", "id"),
+		append([]interface{}{entryID}, args...)...)
 	if err != sql.ErrNoRows {
 		checkErr(err)
 	}
 	comments := make([]Comment, 0, 10)
 	for rows.Next() {
-		c := Comment{}
-		checkErr(rows.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt))
+		c, err := scanComment(rows)
+		checkErr(err)
 		comments = append(comments, c)
 	}
 	rows.Close()
+	fetched := len(comments)
+	comments = comments[:pq.keep(fetched)]
+	if pq.backward {
+		for i := 0; i < len(comments)/2; i++ {
+			comments[i], comments[len(comments)-1-i] = comments[len(comments)-1-i], comments[i]
+		}
+	}
+	var pager Pager
+	if len(comments) > 0 {
+		first, last := comments[0], comments[len(comments)-1]
+		pager = pq.pager(fetched, Cursor{first.CreatedAt, first.ID}, Cursor{last.CreatedAt, last.ID})
+	}
+	return threadComments(ctx, comments), pager
+}
 
+func GetEntry(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	entryID := mux.Vars(r)["entry_id"]
+	row := dbQueryRow(r.Context(), db, "entries.get", `SELECT id, user_id, private, list_id, comment_policy, title, body, created_at FROM entries2 WHERE id = ?`, entryID)
+	var id, userID, listID int
+	var audience Audience
+	var policy CommentPolicy
+	var title, body string
+	var createdAt time.Time
+	err := row.Scan(&id, &userID, &audience, &listID, &policy, &title, &body, &createdAt)
+	if err == sql.ErrNoRows {
+		return ErrContentNotFound
+	}
+	checkErr(err)
+	entry := Entry{id, userID, audience, listID, policy, title, body, createdAt, 0}
+	owner := getUser(entry.UserID)
 	currentUser := getCurrentUser(w, r)
-	markFootprint(currentUser.ID, owner.ID)
+	if !entry.visibleTo(currentUser.ID) {
+		return ErrPermissionDenied
+	}
+	comments, pager := fetchComments(r.Context(), entry.ID, newPageQuery(r, commentsPerPage, false))
+
+	markFootprint(r.Context(), currentUser.ID, owner.ID)
+
+	var lists []FriendList
+	if currentUser.ID == owner.ID {
+		lists = friendListRepo.ListsOf(owner.ID)
+	}
+	var commentError string
+	if err := entry.commentableBy(currentUser.ID); err != nil {
+		commentError = err.(*HTTPError).Message
+	}
+	render(w, r, http.StatusOK, "entry.html", &struct {
+		Page
+		Owner        *User
+		Entry        Entry
+		Comments     []Comment
+		Myself       bool
+		ViewerID     int
+		Pager        Pager
+		Lists        []FriendList
+		CommentError string
+	}{Page{}, owner, entry, comments, currentUser.ID == owner.ID, currentUser.ID, pager, lists, commentError})
+	return nil
+}
 
-	render(w, r, http.StatusOK, "entry.html", struct {
-		Owner    *User
-		Entry    Entry
-		Comments []Comment
-	}{owner, entry, comments})
+func insertEntry(ctx context.Context, user *User, title, content string, audience Audience, listID int, policy CommentPolicy) Entry {
+	// created_at is set here, truncated to the column's precision, so that the
+	// cached copy matches the row exactly.
+	now := time.Now().Truncate(time.Second)
+	result, err := dbExec(ctx, db, "entries.insert", `INSERT INTO entries2 (user_id, private, list_id, comment_policy, title, body, created_at) VALUES (?,?,?,?,?,?,?)`,
+		user.ID, audience, listID, policy, title, content, now)
+	checkErr(err)
+	lastID, err := result.LastInsertId()
+	checkErr(err)
+	e := Entry{ID: int(lastID), UserID: user.ID, Audience: audience, ListID: listID, CommentPolicy: policy, Title: title, CreatedAt: now}
+	entryCache.Insert(e)
+	e.Content = content
+	searchIndex.AddEntry(e)
+	notifyMentions(ctx, e, user.ID, content, 0, make(map[int]bool))
+	return e
 }
 
-func PostEntry(w http.ResponseWriter, r *http.Request) {
+func PostEntry(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	user := getCurrentUser(w, r)
@@ -717,190 +978,293 @@ func PostEntry(w http.ResponseWriter, r *http.Request) {
 		title = "タイトルなし"
 	}
 	content := r.FormValue("content")
-	var private int
-	if r.FormValue("private") == "" {
-		private = 0
-	} else {
-		private = 1
+	audience, listID, err := formAudience(r, user.ID)
+	if err != nil {
+		return err
 	}
-	_, err := db.Exec(`INSERT INTO entries2 (user_id, private, title, body) VALUES (?,?,?,?)`, user.ID, private, title, content)
-	checkErr(err)
+	policy, err := parseCommentPolicy(r.FormValue("comment_policy"))
+	if err != nil {
+		return err
+	}
+	insertEntry(r.Context(), user, title, content, audience, listID, policy)
 	http.Redirect(w, r, "/diary/entries/"+user.AccountName, http.StatusSeeOther)
+	return nil
 }
 
-func PostComment(w http.ResponseWriter, r *http.Request) {
+// insertComment adds a comment by user to entry, replying to parent unless
+// it is nil. Permissions are checked by the caller.
+func insertComment(ctx context.Context, entry Entry, user *User, text string, parent *Comment) Comment {
+	// As in insertEntry, the cached copy gets the created_at stored in the row.
+	c := Comment{EntryID: entry.ID, UserID: user.ID, Comment: text, CreatedAt: time.Now().Truncate(time.Second), EntryOwnerID: entry.UserID,
+		entryAudience: entry.Audience, entryListID: entry.ListID}
+	if parent != nil {
+		c.replyTo(parent)
+	}
+	result, err := dbExec(ctx, db, "comments.insert", `INSERT INTO comments (entry_id, user_id, comment, entry_user_id, parent_id, root_id, depth, created_at) VALUES (?,?,?,?,?,?,?,?)`,
+		entry.ID, user.ID, text, entry.UserID, c.ParentID, c.RootID, c.Depth, c.CreatedAt)
+	checkErr(err)
+	lastId, _ := result.LastInsertId()
+	c.ID = int(lastId)
+	commentCache.Insert(c)
+	searchIndex.AddComment(c)
+	notifyComment(ctx, entry, c, parent)
+	return c
+}
+
+func PostComment(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 
 	entryID := mux.Vars(r)["entry_id"]
-	row := db.QueryRow(`SELECT id, user_id, private FROM entries2 WHERE id = ?`, entryID)
-	var id, userID, private int
-	err := row.Scan(&id, &userID, &private)
+	row := dbQueryRow(r.Context(), db, "entries.get_owner", `SELECT id, user_id, private, list_id, comment_policy FROM entries2 WHERE id = ?`, entryID)
+	var id, userID, listID int
+	var audience Audience
+	var policy CommentPolicy
+	err := row.Scan(&id, &userID, &audience, &listID, &policy)
 	if err == sql.ErrNoRows {
-		render(w, r, http.StatusNotFound, "error.html", struct{ Message string }{"要求されたコンテンツは存在しません"})
-		return
+		return ErrContentNotFound
 	}
 	checkErr(err)
 
-	entry := Entry{ID: id, UserID: userID, Private: private == 1}
-	owner := getUser(entry.UserID)
-	if entry.Private {
-		if !permitted(w, r, owner.ID) {
-			permissionDenied(w, r)
-		}
-	}
+	entry := Entry{ID: id, UserID: userID, Audience: audience, ListID: listID, CommentPolicy: policy}
 	user := getCurrentUser(w, r)
+	if err := entry.commentableBy(user.ID); err != nil {
+		return err
+	}
+	parentID, _ := strconv.Atoi(r.FormValue("parent_id"))
+	parent, err := replyParent(r.Context(), entry, parentID)
+	if err != nil {
+		return err
+	}
 
-	result, err := db.Exec(`INSERT INTO comments (entry_id, user_id, comment, entry_user_id) VALUES (?,?,?,?)`, entry.ID, user.ID, r.FormValue("comment"), entry.UserID)
-	checkErr(err)
-	lastId, _ := result.LastInsertId()
-	c := Comment{ID: int(lastId), EntryID: entry.ID, UserID: user.ID, Comment: r.FormValue("comment"), CreatedAt: time.Now(), EntryOwnerID: entry.UserID, private: entry.Private}
-	commentCache.Insert(c)
+	insertComment(r.Context(), entry, user, r.FormValue("comment"), parent)
 	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	return nil
 }
 
-func GetFootprints(w http.ResponseWriter, r *http.Request) {
-	if !authenticated(w, r) {
-		return
+// footprintPage returns a page of the footprints left on userID's pages.
+// The first page comes from footPrintCache.
+func footprintPage(ctx context.Context, userID int, pq pageQuery) ([]Footprint, Pager) {
+	var footprints []Footprint
+	if pq.hasCursor {
+		footprints = fetchFootprintPage(ctx, userID, pq)
+	} else {
+		footprints = footPrintCache.Recent(ctx, userID, pq.limit+1)
 	}
-	user := getCurrentUser(w, r)
-	footprints := footPrintCache.Get(user.ID)
-	render(w, r, http.StatusOK, "footprints.html",
-		struct{ Footprints []Footprint }{footprints[:50]})
+	fetched := len(footprints)
+	footprints = footprints[:pq.keep(fetched)]
+	if pq.backward {
+		for i := 0; i < len(footprints)/2; i++ {
+			footprints[i], footprints[len(footprints)-1-i] = footprints[len(footprints)-1-i], footprints[i]
+		}
+	}
+	var pager Pager
+	if len(footprints) > 0 {
+		first, last := footprints[0], footprints[len(footprints)-1]
+		pager = pq.pager(fetched, Cursor{first.UpdatedAt, first.ID}, Cursor{last.UpdatedAt, last.ID})
+	}
+	return footprints, pager
 }
 
-func GetFriends(w http.ResponseWriter, r *http.Request) {
+func GetFootprints(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
 	user := getCurrentUser(w, r)
-	rows, err := db.Query(`SELECT * FROM relations WHERE one = ? ORDER BY created_at DESC`, user.ID)
+	footprints, pager := footprintPage(r.Context(), user.ID, newPageQuery(r, footprintsPerPage, true))
+	render(w, r, http.StatusOK, "footprints.html", &struct {
+		Page
+		Footprints []Footprint
+		Pager      Pager
+	}{Page{}, footprints, pager})
+	return nil
+}
+
+const friendsPerPage = 50
+
+// fetchFriends returns a page of userID's friends, newest first.
+func fetchFriends(ctx context.Context, userID int, pq pageQuery) ([]Friend, Pager) {
+	cond, args := pq.where("created_at", "id")
+	rows, err := dbQuery(ctx, db, "relations.list", `SELECT id, another, created_at FROM relations WHERE one = ?`+cond+pq.orderLimit("created_at", "id"),
+		append([]interface{}{userID}, args...)...)
 	if err != sql.ErrNoRows {
 		checkErr(err)
 	}
-	friendsMap := make(map[int]time.Time)
+	friends := make([]Friend, 0, pq.limit+1)
 	for rows.Next() {
-		var id, one, another int
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &one, &another, &createdAt))
-		var friendID int
-		if one == user.ID {
-			friendID = another
-		} else {
-			friendID = one
-		}
-		if _, ok := friendsMap[friendID]; !ok {
-			friendsMap[friendID] = createdAt
-		}
+		var f Friend
+		checkErr(rows.Scan(&f.relationID, &f.ID, &f.CreatedAt))
+		friends = append(friends, f)
 	}
 	rows.Close()
-	friends := make([]Friend, 0, len(friendsMap))
-	for key, val := range friendsMap {
-		friends = append(friends, Friend{key, val})
+	fetched := len(friends)
+	friends = friends[:pq.keep(fetched)]
+	if pq.backward {
+		for i := 0; i < len(friends)/2; i++ {
+			friends[i], friends[len(friends)-1-i] = friends[len(friends)-1-i], friends[i]
+		}
 	}
-	render(w, r, http.StatusOK, "friends.html", struct{ Friends []Friend }{friends})
+	var pager Pager
+	if len(friends) > 0 {
+		first, last := friends[0], friends[len(friends)-1]
+		pager = pq.pager(fetched, Cursor{first.CreatedAt, first.relationID}, Cursor{last.CreatedAt, last.relationID})
+	}
+	return friends, pager
 }
 
-func PostFriends(w http.ResponseWriter, r *http.Request) {
+func GetFriends(w http.ResponseWriter, r *http.Request) error {
 	if !authenticated(w, r) {
-		return
+		return nil
 	}
-
 	user := getCurrentUser(w, r)
-	anotherAccount := mux.Vars(r)["account_name"]
-	if !isFriendAccount(w, r, anotherAccount) {
-		another := getUserFromAccount(w, anotherAccount)
-		_, err := db.Exec(`INSERT INTO relations (one, another) VALUES (?,?), (?,?)`, user.ID, another.ID, another.ID, user.ID)
-		checkErr(err)
-		friendRepo.Insert(user.ID, another.ID)
-		http.Redirect(w, r, "/friends", http.StatusSeeOther)
-	}
+	friends, pager := fetchFriends(r.Context(), user.ID, newPageQuery(r, friendsPerPage, true))
+	render(w, r, http.StatusOK, "friends.html", &struct {
+		Page
+		Friends []Friend
+		Pager   Pager
+	}{Page{}, friends, pager})
+	return nil
 }
 
-func GetInitialize(w http.ResponseWriter, r *http.Request) {
-	db.Exec("DELETE FROM relations WHERE id > 500000")
-	db.Exec("DELETE FROM footprints WHERE id > 500000")
-	db.Exec("DELETE FROM entries2 WHERE id > 500000")
-	db.Exec("DELETE FROM comments WHERE id > 1500000")
-	friendRepo.Init()
-	commentCache.Init()
-	userRepo.Init()
+// The last IDs of the initial data, kept by /initialize.
+const (
+	initialMaxEntryID   = 500000
+	initialMaxCommentID = 1500000
+)
+
+func GetInitialize(w http.ResponseWriter, r *http.Request) error {
+	dbExec(r.Context(), db, "initialize.relations", "DELETE FROM relations WHERE id > 500000")
+	dbExec(r.Context(), db, "initialize.footprints", "DELETE FROM footprints WHERE id > 500000")
+	dbExec(r.Context(), db, "initialize.entries", "DELETE FROM entries2 WHERE id > ?", initialMaxEntryID)
+	dbExec(r.Context(), db, "initialize.comments", "DELETE FROM comments WHERE id > ?", initialMaxCommentID)
+	dbExec(r.Context(), db, "initialize.friend_requests", "DELETE FROM friend_requests")
+	dbExec(r.Context(), db, "initialize.blocks", "DELETE FROM blocks")
+	dbExec(r.Context(), db, "initialize.api_tokens", "DELETE FROM api_tokens")
+	dbExec(r.Context(), db, "initialize.login_failures", "DELETE FROM login_failures")
+	dbExec(r.Context(), db, "initialize.sessions", "DELETE FROM sessions")
+	dbExec(r.Context(), db, "initialize.friend_list_members", "DELETE FROM friend_list_members")
+	dbExec(r.Context(), db, "initialize.friend_lists", "DELETE FROM friend_lists")
+	dbExec(r.Context(), db, "initialize.notifications", "DELETE FROM notifications")
 	footPrintCache.Reset()
-	entryCache.Init()
-	profileRepo.Init()
+	searchIndex.Truncate(initialMaxEntryID, initialMaxCommentID)
+	initRepos(r.Context())
 	//db.Exec("SELECT title FROM entries2 ORDER BY id desc LIMIT 10000")
+	return nil
 }
 
 func main() {
-	var err error
-	for {
-		db, err = sql.Open("mysql", "root@unix(/var/run/mysqld/mysqld.sock)/isucon5q?loc=Local&parseTime=true&interpolateParams=true")
-		//db, err = sql.Open("mysql", "root@tcp(127.0.0.1:3306)/isucon5q?loc=Local&parseTime=true&interpolateParams=true")
-		if err != nil {
-			log.Println("Failed to open DB: %s.", err.Error())
-			time.Sleep(time.Second)
-			continue
-		}
-		err = db.Ping()
-		if err != nil {
-			log.Println("Failed to connect to DB: %s.", err)
-			db.Close()
-			time.Sleep(time.Second)
-			continue
-		}
-		break
-	}
-	db.SetMaxIdleConns(50)
-	defer db.Close()
+	mustLoadConfig()
+	initTemplates()
 
-	ssecret := os.Getenv("ISUCON5_SESSION_SECRET")
-	if ssecret == "" {
-		ssecret = "beermoris"
-	}
-	store = sessions.NewCookieStore([]byte(ssecret))
+	sessionStore.secret = []byte(config.SessionSecret)
 
 	r := mux.NewRouter()
 
-	l := r.Path("/login").Subrouter()
-	l.Methods("GET").HandlerFunc(http.HandlerFunc(GetLogin))
-	l.Methods("POST").HandlerFunc(http.HandlerFunc(PostLogin))
-	r.Path("/logout").Methods("GET").HandlerFunc(http.HandlerFunc(GetLogout))
-
-	p := r.Path("/profile/{account_name}").Subrouter()
-	p.Methods("GET").HandlerFunc(http.HandlerFunc(GetProfile))
-	p.Methods("POST").HandlerFunc(http.HandlerFunc(PostProfile))
-
-	d := r.PathPrefix("/diary").Subrouter()
-	d.HandleFunc("/entries/{account_name}", http.HandlerFunc(ListEntries)).Methods("GET")
-	d.HandleFunc("/entry", http.HandlerFunc(PostEntry)).Methods("POST")
-	d.HandleFunc("/entry/{entry_id}", http.HandlerFunc(GetEntry)).Methods("GET")
-
-	d.HandleFunc("/comment/{entry_id}", http.HandlerFunc(PostComment)).Methods("POST")
-
-	r.HandleFunc("/footprints", http.HandlerFunc(GetFootprints)).Methods("GET")
-
-	r.HandleFunc("/friends", http.HandlerFunc(GetFriends)).Methods("GET")
-	r.HandleFunc("/friends/{account_name}", http.HandlerFunc(PostFriends)).Methods("POST")
-
-	r.HandleFunc("/initialize", http.HandlerFunc(GetInitialize))
-	r.HandleFunc("/", http.HandlerFunc(GetIndex))
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("../static")))
-	friendRepo.Init()
-	commentCache.Init()
-	userRepo.Init()
-	entryCache.Init()
-	profileRepo.Init()
-	go http.ListenAndServe(":3000", nil)
-	go http.ListenAndServe(":8080", r)
-	os.Remove(UnixPath)
-	ul, err := net.Listen("unix", UnixPath)
+	handle(r, "GET", "/login", GetLogin)
+	handle(r, "POST", "/login", PostLogin)
+	handle(r, "GET", "/logout", GetLogout)
+
+	handle(r, "GET", "/signup", GetSignup)
+	handle(r, "POST", "/signup", PostSignup)
+	handle(r, "POST", "/account/deactivate", PostAccountDeactivate)
+	handle(r, "POST", "/account/delete", PostAccountDelete)
+
+	handle(r, "GET", "/profile/{account_name}", GetProfile)
+	handle(r, "POST", "/profile/{account_name}", PostProfile)
+
+	handle(r, "GET", "/diary/entries/{account_name}", ListEntries)
+	handle(r, "POST", "/diary/entry", PostEntry)
+	handle(r, "GET", "/diary/entry/{entry_id}", GetEntry)
+	handle(r, "POST", "/diary/entry/{entry_id}/edit", PostEntryEdit)
+	handle(r, "POST", "/diary/entry/{entry_id}/delete", PostEntryDelete)
+	handle(r, "GET", "/diary/entry/{entry_id}/revisions", GetEntryRevisions)
+
+	handle(r, "POST", "/diary/comment/{entry_id}", PostComment)
+	handle(r, "POST", "/diary/comment/{comment_id}/delete", PostCommentDelete)
+
+	handle(r, "GET", "/footprints", GetFootprints)
+
+	handle(r, "GET", "/search", GetSearch)
+
+	handle(r, "GET", "/notifications", GetNotifications)
+	handle(r, "POST", "/notifications/read", PostNotificationsRead)
+	handle(r, "POST", "/notifications/{notification_id}/read", PostNotificationRead)
+
+	handle(r, "GET", "/friends", GetFriends)
+	handle(r, "GET", "/friends/requests", GetFriendRequests)
+	handle(r, "POST", "/friends/{account_name}", PostFriends)
+	handle(r, "POST", "/friends/{account_name}/{action:accept|decline|cancel}", PostFriendRequestAction)
+	handle(r, "POST", "/friends/{account_name}/unfriend", PostUnfriend)
+
+	handle(r, "GET", "/lists", GetFriendLists)
+	handle(r, "POST", "/lists", PostFriendList)
+	handle(r, "POST", "/lists/{list_id}/delete", PostFriendListDelete)
+	handle(r, "POST", "/lists/{list_id}/members", PostFriendListMember)
+	handle(r, "POST", "/lists/{list_id}/members/{account_name}/delete", PostFriendListMemberDelete)
+
+	handle(r, "GET", "/blocks", GetBlocks)
+	handle(r, "POST", "/blocks/{account_name}", PostBlock)
+	handle(r, "POST", "/blocks/{account_name}/delete", PostUnblock)
+
+	handle(r, "GET", "/sessions", GetSessions)
+	handle(r, "POST", "/sessions/revoke-all", PostSessionRevokeAll)
+	handle(r, "POST", "/sessions/{session_id}/revoke", PostSessionRevoke)
+
+	handle(r, "GET", "/tokens", GetTokens)
+	handle(r, "POST", "/tokens", PostToken)
+	handle(r, "POST", "/tokens/{token_id}/revoke", PostTokenRevoke)
+
+	handle(r, "POST", "/api/v1/tokens", APIPostToken)
+	handleScoped(r, "DELETE", "/api/v1/tokens/current", scopeAny, APIDeleteToken)
+
+	handleScoped(r, "GET", "/api/v1/me", scopeAny, APIGetMe)
+	handleScoped(r, "GET", "/api/v1/users/{account_name}", scopeAny, APIGetUser)
+	handleScoped(r, "GET", "/api/v1/users/{account_name}/entries", ScopeEntriesRead, APIListEntries)
+
+	handleScoped(r, "POST", "/api/v1/entries", ScopeEntriesWrite, APIPostEntry)
+	handleScoped(r, "GET", "/api/v1/entries/{entry_id}", ScopeEntriesRead, APIGetEntry)
+	handleScoped(r, "GET", "/api/v1/entries/{entry_id}/comments", ScopeEntriesRead, APIListComments)
+	handleScoped(r, "POST", "/api/v1/entries/{entry_id}/comments", ScopeEntriesWrite, APIPostComment)
+	handleScoped(r, "DELETE", "/api/v1/comments/{comment_id}", ScopeEntriesWrite, APIDeleteComment)
+
+	handleScoped(r, "GET", "/api/v1/friends", ScopeFriends, APIListFriends)
+	handleScoped(r, "GET", "/api/v1/friends/requests", ScopeFriends, APIListFriendRequests)
+	handleScoped(r, "POST", "/api/v1/friends/{account_name}", ScopeFriends, APIPostFriend)
+	handleScoped(r, "DELETE", "/api/v1/friends/{account_name}", ScopeFriends, APIDeleteFriend)
+
+	handleScoped(r, "GET", "/api/v1/footprints", ScopeFootprintsRead, APIListFootprints)
+
+	r.PathPrefix(apiPrefix).Handler(appHandler{apiPrefix, scopeAny, APINotFound})
+
+	r.HandleFunc("/healthz", healthz)
+	r.HandleFunc("/readyz", readyz)
+	handle(r, "", "/initialize", GetInitialize)
+	handle(r, "", "/", GetIndex)
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir(config.StaticDir)))
+
+	ls, err := openListeners()
 	if err != nil {
-		panic(err)
+		fatal("failed to listen", "err", err)
 	}
-	os.Chmod(UnixPath, 0777)
-	defer ul.Close()
-	log.Fatal(http.Serve(ul, r))
+	// Listeners inherited from a previous process are still being served
+	// by it, so only take them over once warm. Fresh ones answer the
+	// probes and 503 in the meantime.
+	h := withRecovery(withWarmup(withCSRF(r)))
+	early, late := ls, []namedListener(nil)
+	if inherited {
+		early, late = splitListeners(ls, "debug")
+	}
+	servers := serve(early, h)
+
+	db = connectDB()
+	defer db.Close()
+	initRepos(context.Background())
+	setReady()
+
+	servers = append(servers, serve(late, h)...)
+	notifyParent()
+	waitForShutdown(ls, servers)
 }
 
 func checkErr(err error) {
@@ -932,7 +1296,7 @@ func renderFriendEntries(es []Entry) template.HTML {
     <li class="list-group-item entry-created-at">投稿時刻:%s</li>
 		  </ul>
 		</div>
-`, owner.AccountName, owner.NickName,
+`, owner.AccountName, template.HTMLEscapeString(owner.NickName),
 			e.ID, template.HTMLEscapeString(e.Title),
 			e.CreatedAt.Format("2006-01-02 15:04:05"))
 		//{{ end }}
@@ -951,10 +1315,7 @@ func renderCommentsOfFriends(comments []Comment) template.HTML {
 	for _, c := range comments {
 		cowner := getUser(c.UserID)
 		eowner := getUser(c.EntryOwnerID)
-		comment := c.Comment
-		if len(comment) > 30 {
-			comment = comment[:27] + "..."
-		}
+		comment := linkMentionsTruncated(c.Comment, 30, 27)
 		fmt.Fprintf(buf, `
       <div class="friend-comment">
         <ul class="list-group">
@@ -963,7 +1324,7 @@ func renderCommentsOfFriends(comments []Comment) template.HTML {
           <li class="list-group-item comment-created-at">投稿時刻:%s</li>
         </ul>
       </div>`, cowner.AccountName, template.HTMLEscapeString(cowner.NickName), eowner.AccountName, template.HTMLEscapeString(eowner.NickName),
-			template.HTMLEscapeString(comment), c.CreatedAt.Format("2006-01-02 15:04:05"))
+			comment, c.CreatedAt.Format("2006-01-02 15:04:05"))
 	}
 	buf.WriteString(`</div></div>`)
 	return template.HTML(buf.String())
@@ -975,7 +1336,7 @@ func renderEntriesList(entries []Entry) template.HTML {
 <div class="row" id="entries">`)
 	for _, e := range entries {
 		title := template.HTMLEscapeString(e.Title)
-		content := template.HTMLEscapeString(e.Content)
+		content := linkMentions(template.HTMLEscapeString(e.Content))
 		content = strings.Replace(content, "\n", "<br />\n", 0)
 		fmt.Fprintf(buf, `
     <div class="panel panel-primary entry">
@@ -984,8 +1345,8 @@ func renderEntriesList(entries []Entry) template.HTML {
 %s
         </div>
 	`, e.ID, title, content)
-		if e.Private {
-			buf.WriteString(`<div class="text-danger entry-private">範囲: 友だち限定公開</div>`)
+		if e.Audience != AudiencePublic {
+			fmt.Fprintf(buf, `<div class="text-danger entry-private">範囲: %s</div>`, template.HTMLEscapeString(e.AudienceLabel()))
 		}
 		fmt.Fprintf(buf, `
         <div class="entry-created-at">更新日時: %s</div>
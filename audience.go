@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Audience is who may read an entry. It is stored in entries2.private, whose
+// original values 0 and 1 mean public and friends only.
+type Audience int
+
+const (
+	AudiencePublic Audience = iota
+	AudienceFriends
+	AudienceFriendsOfFriends
+	AudienceList // members of the owner's friend list entries2.list_id
+	AudienceOnlyMe
+)
+
+var audienceNames = map[Audience]string{
+	AudiencePublic:           "public",
+	AudienceFriends:          "friends",
+	AudienceFriendsOfFriends: "friends_of_friends",
+	AudienceList:             "list",
+	AudienceOnlyMe:           "only_me",
+}
+
+func (a Audience) String() string {
+	return audienceNames[a]
+}
+
+// canView reports whether viewerID may read an entry of ownerID's with
+// audience a and, for AudienceList, the friend list listID. Every check of
+// entry visibility goes through here, or through audienceFilter for queries.
+// A deactivated owner's entries are hidden whatever their audience.
+func canView(viewerID, ownerID int, a Audience, listID int) bool {
+	if viewerID == ownerID {
+		return true
+	}
+	if owner := userRepo.Get(ownerID); owner != nil && owner.Deactivated {
+		return false
+	}
+	if a == AudiencePublic {
+		return true
+	}
+	if blockRepo.Between(viewerID, ownerID) {
+		return false
+	}
+	switch a {
+	case AudienceFriends:
+		return friendRepo.IsFriend(viewerID, ownerID)
+	case AudienceFriendsOfFriends:
+		return friendRepo.IsFriend(viewerID, ownerID) || friendRepo.HasMutual(viewerID, ownerID)
+	case AudienceList:
+		return friendListRepo.IsMember(listID, ownerID, viewerID)
+	}
+	return false
+}
+
+// audienceFilter returns the condition to append to a query on ownerID's
+// entries2 rows, with its arguments, that leaves only those viewerID may
+// read. It agrees with canView.
+func audienceFilter(viewerID, ownerID int) (string, []interface{}) {
+	if viewerID == ownerID {
+		return "", nil
+	}
+	if owner := userRepo.Get(ownerID); owner != nil && owner.Deactivated {
+		return " AND FALSE", nil
+	}
+	cond := " AND (private = 0"
+	var args []interface{}
+	if !blockRepo.Between(viewerID, ownerID) {
+		friend := friendRepo.IsFriend(viewerID, ownerID)
+		if friend {
+			cond += " OR private = 1"
+		}
+		if friend || friendRepo.HasMutual(viewerID, ownerID) {
+			cond += " OR private = 2"
+		}
+		if ids := friendListRepo.ListsContaining(ownerID, viewerID); len(ids) > 0 {
+			cond += " OR (private = 3 AND list_id IN (?" + strings.Repeat(",?", len(ids)-1) + "))"
+			for _, id := range ids {
+				args = append(args, id)
+			}
+		}
+	}
+	return cond + ")", args
+}
+
+func (e Entry) visibleTo(viewerID int) bool {
+	return canView(viewerID, e.UserID, e.Audience, e.ListID)
+}
+
+func audienceLabel(a Audience, listID int) string {
+	switch a {
+	case AudiencePublic:
+		return "全体に公開"
+	case AudienceFriends:
+		return "友だち限定公開"
+	case AudienceFriendsOfFriends:
+		return "友だちの友だちまで公開"
+	case AudienceList:
+		if l := friendListRepo.Get(listID); l != nil {
+			return "リスト「" + l.Name + "」限定公開"
+		}
+		return "リスト限定公開"
+	}
+	return "自分のみ"
+}
+
+func (e Entry) AudienceLabel() string {
+	return audienceLabel(e.Audience, e.ListID)
+}
+
+// AudienceValue is the value of the audience select in entry forms.
+func (e Entry) AudienceValue() string {
+	if e.Audience == AudienceList {
+		return "list:" + strconv.Itoa(e.ListID)
+	}
+	return e.Audience.String()
+}
+
+// parseAudience reads an audience given by name, with listID for
+// AudienceList, checking that the list belongs to userID.
+func parseAudience(userID int, name string, listID int) (Audience, int, error) {
+	for a, n := range audienceNames {
+		if n != name {
+			continue
+		}
+		if a != AudienceList {
+			return a, 0, nil
+		}
+		if l := friendListRepo.Get(listID); l == nil || l.UserID != userID {
+			return 0, 0, ErrBadRequest
+		}
+		return a, listID, nil
+	}
+	return 0, 0, ErrBadRequest
+}
+
+// formAudience reads the audience select of an entry form, whose list
+// options are "list:<id>". Without it, the old private checkbox is honoured.
+func formAudience(r *http.Request, userID int) (Audience, int, error) {
+	v := r.FormValue("audience")
+	if v == "" {
+		if r.FormValue("private") != "" {
+			return AudienceFriends, 0, nil
+		}
+		return AudiencePublic, 0, nil
+	}
+	listID := 0
+	if strings.HasPrefix(v, "list:") {
+		id, err := strconv.Atoi(v[len("list:"):])
+		if err != nil {
+			return 0, 0, ErrBadRequest
+		}
+		v, listID = "list", id
+	}
+	return parseAudience(userID, v, listID)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The users of the audience tests. owner's friends are friend, member and
+// blocked; fof is a friend of friend only.
+const (
+	owner = iota + 1
+	friend
+	fof
+	stranger
+	member // on owner's list 10
+	blocked
+	deactivated
+)
+
+// withAudienceRepos gives the test users, friends, a block and friend lists
+// to check audiences against, restoring the real repos when it ends.
+func withAudienceRepos(t *testing.T) {
+	users, friends, blocks, lists, members := userRepo.users, friendRepo.friend, blockRepo.blocked, friendListRepo.lists, friendListRepo.members
+	t.Cleanup(func() {
+		userRepo.users, friendRepo.friend, blockRepo.blocked = users, friends, blocks
+		friendListRepo.lists, friendListRepo.members = lists, members
+	})
+
+	userRepo.users = make(map[int]*User)
+	for id := owner; id <= deactivated; id++ {
+		userRepo.users[id] = &User{ID: id, Deactivated: id == deactivated}
+	}
+	friendRepo.friend = make(map[int]map[int]bool)
+	for _, pair := range [][2]int{{owner, friend}, {owner, member}, {owner, blocked}, {friend, fof}, {deactivated, friend}} {
+		friendRepo.Insert(pair[0], pair[1])
+	}
+	blockRepo.blocked = make(map[int]map[int]time.Time)
+	blockRepo.Insert(Block{UserID: blocked, BlockedID: owner})
+	friendListRepo.lists = make(map[int]FriendList)
+	friendListRepo.members = make(map[int]map[int]bool)
+	friendListRepo.Insert(FriendList{ID: 10, UserID: owner, Name: "close"})
+	friendListRepo.AddMember(10, member)
+	friendListRepo.AddMember(10, blocked)
+	friendListRepo.Insert(FriendList{ID: 20, UserID: friend, Name: "other"})
+}
+
+func TestParseAudience(t *testing.T) {
+	withAudienceRepos(t)
+	tests := []struct {
+		name     string
+		listID   int
+		want     Audience
+		wantList int
+		ok       bool
+	}{
+		{"public", 0, AudiencePublic, 0, true},
+		{"friends", 0, AudienceFriends, 0, true},
+		{"friends_of_friends", 0, AudienceFriendsOfFriends, 0, true},
+		{"only_me", 0, AudienceOnlyMe, 0, true},
+		{"only_me", 10, AudienceOnlyMe, 0, true}, // the list is ignored
+		{"list", 10, AudienceList, 10, true},
+		{"list", 20, 0, 0, false}, // someone else's list
+		{"list", 30, 0, 0, false}, // no such list
+		{"list", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+		{"Public", 0, 0, 0, false},
+		{"private", 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		a, listID, err := parseAudience(owner, tt.name, tt.listID)
+		if ok := err == nil; ok != tt.ok || a != tt.want || listID != tt.wantList {
+			t.Errorf("parseAudience(%q, %d) = %v, %d, %v, want %v, %d, ok %v", tt.name, tt.listID, a, listID, err, tt.want, tt.wantList, tt.ok)
+		}
+	}
+}
+
+func TestCanView(t *testing.T) {
+	withAudienceRepos(t)
+	// Who of the active users may read an entry of owner's, by audience;
+	// list entries are on list 10.
+	tests := []struct {
+		audience Audience
+		viewers  map[int]bool
+	}{
+		{AudiencePublic, map[int]bool{owner: true, friend: true, fof: true, stranger: true, member: true, blocked: true}},
+		{AudienceFriends, map[int]bool{owner: true, friend: true, member: true}},
+		{AudienceFriendsOfFriends, map[int]bool{owner: true, friend: true, fof: true, member: true}},
+		{AudienceList, map[int]bool{owner: true, member: true}},
+		{AudienceOnlyMe, map[int]bool{owner: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.audience.String(), func(t *testing.T) {
+			for viewer := owner; viewer <= blocked; viewer++ {
+				listID := 0
+				if tt.audience == AudienceList {
+					listID = 10
+				}
+				if got := canView(viewer, owner, tt.audience, listID); got != tt.viewers[viewer] {
+					t.Errorf("canView(%d) = %v, want %v", viewer, got, tt.viewers[viewer])
+				}
+			}
+		})
+	}
+}
+
+func TestCanViewDeactivated(t *testing.T) {
+	withAudienceRepos(t)
+	for _, a := range []Audience{AudiencePublic, AudienceFriends, AudienceOnlyMe} {
+		if canView(friend, deactivated, a, 0) {
+			t.Errorf("a friend can read a deactivated user's %v entry", a)
+		}
+		if !canView(deactivated, deactivated, a, 0) {
+			t.Errorf("a deactivated user can't read their own %v entry", a)
+		}
+	}
+}
+
+func TestCanViewListOfAnotherOwner(t *testing.T) {
+	withAudienceRepos(t)
+	// List 10 is owner's; an entry of friend's naming it shows to no one
+	// else.
+	if canView(member, friend, AudienceList, 10) {
+		t.Error("a member of owner's list can read friend's entry on that list")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type Block struct {
+	UserID    int // ブロックした人
+	BlockedID int // ブロックされた人
+	CreatedAt time.Time
+}
+
+type BlockRepo struct {
+	sync.Mutex
+	blocked map[int]map[int]time.Time
+}
+
+var blockRepo = BlockRepo{blocked: make(map[int]map[int]time.Time, 1024)}
+
+func (br *BlockRepo) Init(ctx context.Context) {
+	br.Lock()
+	defer br.Unlock()
+	br.blocked = make(map[int]map[int]time.Time, 1024)
+	rows, err := dbQuery(ctx, db, "blocks.init", `SELECT user_id, blocked_user_id, created_at FROM blocks`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	for rows.Next() {
+		var b Block
+		checkErr(rows.Scan(&b.UserID, &b.BlockedID, &b.CreatedAt))
+		br.insert(b)
+	}
+	rows.Close()
+}
+
+func (br *BlockRepo) insert(b Block) {
+	m := br.blocked[b.UserID]
+	if m == nil {
+		m = make(map[int]time.Time)
+		br.blocked[b.UserID] = m
+	}
+	m[b.BlockedID] = b.CreatedAt
+}
+
+func (br *BlockRepo) Insert(b Block) {
+	br.Lock()
+	br.insert(b)
+	br.Unlock()
+}
+
+func (br *BlockRepo) Remove(userID, blockedID int) {
+	br.Lock()
+	delete(br.blocked[userID], blockedID)
+	br.Unlock()
+}
+
+func (br *BlockRepo) RemoveUser(id int) {
+	br.Lock()
+	delete(br.blocked, id)
+	for _, m := range br.blocked {
+		delete(m, id)
+	}
+	br.Unlock()
+}
+
+// IsBlocked reports whether userID has blocked another.
+func (br *BlockRepo) IsBlocked(userID, another int) bool {
+	br.Lock()
+	_, ok := br.blocked[userID][another]
+	br.Unlock()
+	return ok
+}
+
+// Between reports whether either user has blocked the other.
+func (br *BlockRepo) Between(a, b int) bool {
+	br.Lock()
+	_, ab := br.blocked[a][b]
+	_, ba := br.blocked[b][a]
+	br.Unlock()
+	return ab || ba
+}
+
+func (br *BlockRepo) List(userID int) []Block {
+	br.Lock()
+	blocks := make([]Block, 0, len(br.blocked[userID]))
+	for id, t := range br.blocked[userID] {
+		blocks = append(blocks, Block{userID, id, t})
+	}
+	br.Unlock()
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].CreatedAt.After(blocks[j].CreatedAt) })
+	return blocks
+}
+
+func deleteRelations(ctx context.Context, tx *sql.Tx, a, b int) error {
+	_, err := dbExec(ctx, tx, "relations.delete_pair", `DELETE FROM relations WHERE (one = ? AND another = ?) OR (one = ? AND another = ?)`, a, b, b, a)
+	return err
+}
+
+func unfriend(ctx context.Context, a, b int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = deleteRelations(ctx, tx, a, b)
+	if err == nil {
+		err = deleteListMemberships(ctx, tx, a, b)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	friendRepo.Remove(a, b)
+	friendListRepo.RemovePair(a, b)
+	return nil
+}
+
+func PostUnfriend(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	another := getUserFromAccount(w, mux.Vars(r)["account_name"])
+	if another == nil {
+		return ErrContentNotFound
+	}
+	if err := unfriend(r.Context(), user.ID, another.ID); err != nil {
+		return Internal(err)
+	}
+	http.Redirect(w, r, "/friends", http.StatusSeeOther)
+	return nil
+}
+
+func GetBlocks(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	render(w, r, http.StatusOK, "blocks.html", &struct {
+		Page
+		Blocks []Block
+	}{Blocks: blockRepo.List(user.ID)})
+	return nil
+}
+
+// PostBlock blocks the named user. Any friendship and pending friend request
+// between the two users is removed as well.
+func PostBlock(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	another := getUserFromAccount(w, mux.Vars(r)["account_name"])
+	if another == nil || another.ID == user.ID {
+		return ErrContentNotFound
+	}
+
+	now := time.Now()
+	tx, err := db.BeginTx(r.Context(), nil)
+	checkErr(err)
+	_, err = dbExec(r.Context(), tx, "blocks.insert", `INSERT IGNORE INTO blocks (user_id, blocked_user_id, created_at) VALUES (?,?,?)`, user.ID, another.ID, now)
+	if err == nil {
+		err = deleteRelations(r.Context(), tx, user.ID, another.ID)
+	}
+	if err == nil {
+		err = deleteListMemberships(r.Context(), tx, user.ID, another.ID)
+	}
+	if err == nil {
+		_, err = dbExec(r.Context(), tx, "friend_requests.delete_pair", `DELETE FROM friend_requests WHERE (from_user_id = ? AND to_user_id = ?) OR (from_user_id = ? AND to_user_id = ?)`,
+			user.ID, another.ID, another.ID, user.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return Internal(err)
+	}
+	checkErr(tx.Commit())
+
+	blockRepo.Insert(Block{user.ID, another.ID, now})
+	friendRepo.Remove(user.ID, another.ID)
+	friendListRepo.RemovePair(user.ID, another.ID)
+	friendRequestRepo.Remove(user.ID, another.ID)
+	friendRequestRepo.Remove(another.ID, user.ID)
+	http.Redirect(w, r, "/blocks", http.StatusSeeOther)
+	return nil
+}
+
+func PostUnblock(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	another := getUserFromAccount(w, mux.Vars(r)["account_name"])
+	if another == nil {
+		return ErrContentNotFound
+	}
+	_, err := dbExec(r.Context(), db, "blocks.delete", `DELETE FROM blocks WHERE user_id = ? AND blocked_user_id = ?`, user.ID, another.ID)
+	checkErr(err)
+	blockRepo.Remove(user.ID, another.ID)
+	http.Redirect(w, r, "/blocks", http.StatusSeeOther)
+	return nil
+}
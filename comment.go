@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// CommentPolicy is who may comment on an entry, among those who can read it.
+// It is stored in entries2.comment_policy.
+type CommentPolicy int
+
+const (
+	CommentsOpen CommentPolicy = iota
+	CommentsFriends
+	CommentsDisabled
+)
+
+var commentPolicyNames = map[CommentPolicy]string{
+	CommentsOpen:     "open",
+	CommentsFriends:  "friends",
+	CommentsDisabled: "disabled",
+}
+
+var commentPolicyLabels = map[CommentPolicy]string{
+	CommentsOpen:     "誰でもコメントできます",
+	CommentsFriends:  "友だちのみコメントできます",
+	CommentsDisabled: "コメントを受け付けていません",
+}
+
+func (p CommentPolicy) String() string {
+	return commentPolicyNames[p]
+}
+
+func parseCommentPolicy(name string) (CommentPolicy, error) {
+	if name == "" {
+		return CommentsOpen, nil
+	}
+	for p, n := range commentPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, ErrBadRequest
+}
+
+func (e Entry) CommentPolicyLabel() string {
+	return commentPolicyLabels[e.CommentPolicy]
+}
+
+// commentableBy returns nil if userID may comment on e, or the error to
+// respond with.
+func (e Entry) commentableBy(userID int) error {
+	if !e.visibleTo(userID) {
+		return ErrPermissionDenied
+	}
+	if blockRepo.IsBlocked(e.UserID, userID) {
+		return Forbidden("この日記にはコメントできません")
+	}
+	switch e.CommentPolicy {
+	case CommentsDisabled:
+		return Forbidden("この日記へのコメントは受け付けていません")
+	case CommentsFriends:
+		if userID != e.UserID && !friendRepo.IsFriend(userID, e.UserID) {
+			return Forbidden("この日記には友だちしかコメントできません")
+		}
+	}
+	return nil
+}
+
+// maxCommentDepth is how deeply replies nest. A reply to a comment this deep
+// is placed beside it instead.
+const maxCommentDepth = 4
+
+// commentColumns are the columns of comments read by scanComment.
+const commentColumns = `id, entry_id, user_id, comment, created_at, entry_user_id, parent_id, root_id, depth`
+
+func scanComment(row interface {
+	Scan(dest ...interface{}) error
+}) (Comment, error) {
+	c := Comment{}
+	err := row.Scan(&c.ID, &c.EntryID, &c.UserID, &c.Comment, &c.CreatedAt, &c.EntryOwnerID, &c.ParentID, &c.RootID, &c.Depth)
+	return c, err
+}
+
+func fetchComment(ctx context.Context, commentID int) *Comment {
+	c, err := scanComment(dbQueryRow(ctx, db, "comments.get", `SELECT `+commentColumns+` FROM comments WHERE id = ?`, commentID))
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	checkErr(err)
+	return &c
+}
+
+// replyTo places c in the thread as a reply to parent, or beside parent if
+// it is already maxCommentDepth deep.
+func (c *Comment) replyTo(parent *Comment) {
+	c.ParentID, c.RootID, c.Depth = parent.ID, parent.RootID, parent.Depth+1
+	if c.RootID == 0 {
+		c.RootID = parent.ID
+	}
+	if c.Depth > maxCommentDepth {
+		c.ParentID, c.Depth = parent.ParentID, parent.Depth
+	}
+}
+
+// replyParent loads the comment on entry that a new comment replies to, or
+// returns nil when parentID is 0.
+func replyParent(ctx context.Context, entry Entry, parentID int) (*Comment, error) {
+	if parentID == 0 {
+		return nil, nil
+	}
+	c := fetchComment(ctx, parentID)
+	if c == nil || c.EntryID != entry.ID {
+		return nil, ErrBadRequest
+	}
+	return c, nil
+}
+
+// fetchThreads returns every reply in the threads started by rootIDs,
+// oldest first.
+func fetchThreads(ctx context.Context, rootIDs []interface{}) []Comment {
+	rows, err := dbQuery(ctx, db, "comments.replies", `SELECT `+commentColumns+` FROM comments WHERE root_id IN (?`+strings.Repeat(",?", len(rootIDs)-1)+`) ORDER BY created_at, id`,
+		rootIDs...)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	defer rows.Close()
+	replies := make([]Comment, 0, 10)
+	for rows.Next() {
+		c, err := scanComment(rows)
+		checkErr(err)
+		replies = append(replies, c)
+	}
+	return replies
+}
+
+// threadComments returns roots, each followed by its replies depth first.
+// Replies to the same comment are in the order they were written.
+func threadComments(ctx context.Context, roots []Comment) []Comment {
+	if len(roots) == 0 {
+		return roots
+	}
+	ids := make([]interface{}, len(roots))
+	for i, c := range roots {
+		ids[i] = c.ID
+	}
+	replies := fetchThreads(ctx, ids)
+	present := make(map[int]bool, len(replies))
+	for _, c := range replies {
+		present[c.ID] = true
+	}
+	children := make(map[int][]Comment)
+	for _, c := range replies {
+		parentID := c.ParentID
+		if parentID != c.RootID && !present[parentID] {
+			// Left over from before reparentReplies; show it with the
+			// rest of its thread.
+			parentID = c.RootID
+		}
+		children[parentID] = append(children[parentID], c)
+	}
+	comments := make([]Comment, 0, len(roots)+len(replies))
+	var walk func(c Comment)
+	walk = func(c Comment) {
+		comments = append(comments, c)
+		for _, reply := range children[c.ID] {
+			walk(reply)
+		}
+	}
+	for _, c := range roots {
+		walk(c)
+	}
+	return comments
+}
+
+// Indent is the left margin of a comment in the thread, in em.
+func (c Comment) Indent() int {
+	return c.Depth * 2
+}
+
+// deletableComment loads the comment named in the URL and checks that
+// userID wrote it or owns the entry it is on.
+func deletableComment(r *http.Request, userID int) (*Comment, error) {
+	commentID, err := strconv.Atoi(mux.Vars(r)["comment_id"])
+	if err != nil {
+		return nil, ErrContentNotFound
+	}
+	c := fetchComment(r.Context(), commentID)
+	if c == nil {
+		return nil, ErrContentNotFound
+	}
+	if c.UserID != userID && c.EntryOwnerID != userID {
+		return nil, Forbidden("自分のコメントか自分の日記へのコメントしか削除できません")
+	}
+	return c, nil
+}
+
+// deleteComment deletes c. Replies to it move up to its parent, as they do
+// when their author's account is deleted.
+func deleteComment(ctx context.Context, c *Comment) {
+	var thread []Comment
+	rootID := c.RootID
+	if rootID == 0 {
+		thread = append(thread, *c)
+		rootID = c.ID
+	} else if root := fetchComment(ctx, rootID); root != nil {
+		thread = append(thread, *root)
+	}
+	thread = append(thread, fetchThreads(ctx, []interface{}{rootID})...)
+	moved := rethread(thread, func(t Comment) bool { return t.ID == c.ID })
+
+	tx, err := db.BeginTx(ctx, nil)
+	checkErr(err)
+	unread, err := deleteNotifications(ctx, tx, `comment_id = ?`, c.ID)
+	if err == nil {
+		err = updateThreads(ctx, tx, moved)
+	}
+	if err == nil {
+		_, err = dbExec(ctx, tx, "comments.delete", `DELETE FROM comments WHERE id = ?`, c.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	notificationRepo.Forget(unread)
+	commentCache.Remove(c.ID)
+	searchIndex.RemoveComments(c.ID)
+}
+
+// rethread places the comments of thread that stay under the nearest
+// ancestor that also stays, or at the top level if none does, and returns
+// those whose place changed. thread must be in the order the comments were
+// written, so that a comment's parent is placed by the time it is reached.
+func rethread(thread []Comment, removed func(Comment) bool) []Comment {
+	byID := make(map[int]Comment, len(thread))
+	for _, c := range thread {
+		byID[c.ID] = c
+	}
+	placed := make(map[int]*Comment, len(thread))
+	var moved []Comment
+	for _, c := range thread {
+		if removed(c) {
+			continue
+		}
+		parentID := c.ParentID
+		for parentID != 0 {
+			p, ok := byID[parentID]
+			if !ok {
+				parentID = 0
+			} else if removed(p) {
+				parentID = p.ParentID
+			} else {
+				break
+			}
+		}
+		n := c
+		if parent := placed[parentID]; parent != nil {
+			n.replyTo(parent)
+		} else {
+			n.ParentID, n.RootID, n.Depth = 0, 0, 0
+		}
+		placed[c.ID] = &n
+		if n.ParentID != c.ParentID || n.RootID != c.RootID || n.Depth != c.Depth {
+			moved = append(moved, n)
+		}
+	}
+	return moved
+}
+
+// updateThreads stores the places rethread gave to moved.
+func updateThreads(ctx context.Context, tx *sql.Tx, moved []Comment) error {
+	for _, c := range moved {
+		if _, err := dbExec(ctx, tx, "comments.reparent", `UPDATE comments SET parent_id = ?, root_id = ?, depth = ? WHERE id = ?`, c.ParentID, c.RootID, c.Depth, c.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reparentReplies moves the replies that others wrote to userID's comments
+// under the nearest comment that stays, or to the top level if none does. It
+// runs within tx before userID's comments are deleted. Comments on userID's
+// own entries go with the entries, so only other users' threads are touched.
+func reparentReplies(ctx context.Context, tx *sql.Tx, userID int) error {
+	rows, err := dbQuery(ctx, tx, "comments.threads_of_user", `SELECT DISTINCT IF(root_id = 0, id, root_id) FROM comments WHERE user_id = ? AND entry_user_id != ?`, userID, userID)
+	if err != nil {
+		return err
+	}
+	var roots []interface{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		roots = append(roots, id)
+	}
+	rows.Close()
+	if len(roots) == 0 {
+		return nil
+	}
+
+	in := `(?` + strings.Repeat(",?", len(roots)-1) + `)`
+	rows, err = dbQuery(ctx, tx, "comments.threads", `SELECT `+commentColumns+` FROM comments WHERE id IN `+in+` OR root_id IN `+in+` ORDER BY created_at, id`,
+		append(roots, roots...)...)
+	if err != nil {
+		return err
+	}
+	var thread []Comment
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		thread = append(thread, c)
+	}
+	rows.Close()
+	return updateThreads(ctx, tx, rethread(thread, func(c Comment) bool { return c.UserID == userID }))
+}
+
+func PostCommentDelete(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	c, err := deletableComment(r, getCurrentUser(w, r).ID)
+	if err != nil {
+		return err
+	}
+	deleteComment(r.Context(), c)
+	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(c.EntryID), http.StatusSeeOther)
+	return nil
+}
+
+func APIDeleteComment(w http.ResponseWriter, r *http.Request) error {
+	user, err := apiAuth(w, r)
+	if err != nil {
+		return err
+	}
+	c, err := deletableComment(r, user.ID)
+	if err != nil {
+		return err
+	}
+	deleteComment(r.Context(), c)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
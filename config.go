@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSessionSecret = "beermoris"
+
+// Config is read, in increasing order of precedence, from the defaults below,
+// the JSON file given by -config (or ISUXI_CONFIG), ISUXI_* environment
+// variables named after the flags, and command line flags.
+type Config struct {
+	DSN                string   `json:"dsn"`
+	MaxOpenConns       int      `json:"max_open_conns"`
+	MaxIdleConns       int      `json:"max_idle_conns"`
+	HTTPAddr           string   `json:"http_addr"`
+	DebugAddr          string   `json:"debug_addr"`
+	UnixSocket         string   `json:"unix_socket"`
+	UnixSocketMode     fileMode `json:"unix_socket_mode"`
+	TemplateDir        string   `json:"template_dir"`
+	StaticDir          string   `json:"static_dir"`
+	SessionSecret      string   `json:"session_secret"`
+	PasswordIterations int      `json:"password_iterations"`
+	ShutdownTimeout    duration `json:"shutdown_timeout"`
+	UpgradeBinary      string   `json:"upgrade_binary"`
+	LogFormat          string   `json:"log_format"`
+	LogLevel           string   `json:"log_level"`
+	AccessLog          bool     `json:"access_log"`
+	LoginWindow        duration `json:"login_window"`
+	LoginMaxPerEmail   int      `json:"login_max_per_email"`
+	LoginMaxPerIP      int      `json:"login_max_per_ip"`
+	LoginLockout       duration `json:"login_lockout"`
+	LoginPersist       bool     `json:"login_persist"`
+	Dev                bool     `json:"dev"`
+}
+
+var config Config
+
+func defaultConfig() Config {
+	return Config{
+		DSN:                "root@unix(/var/run/mysqld/mysqld.sock)/isucon5q?loc=Local&parseTime=true&interpolateParams=true",
+		MaxIdleConns:       50,
+		HTTPAddr:           ":8080",
+		DebugAddr:          ":3000",
+		UnixSocket:         "/tmp/isuxi-app.sock",
+		UnixSocketMode:     0777,
+		TemplateDir:        "templates",
+		StaticDir:          "../static",
+		PasswordIterations: passwordIterations,
+		ShutdownTimeout:    duration(10 * time.Second),
+		LogFormat:          "logfmt",
+		LogLevel:           "info",
+		AccessLog:          true,
+		LoginWindow:        duration(15 * time.Minute),
+		LoginMaxPerEmail:   5,
+		LoginMaxPerIP:      50,
+		LoginLockout:       duration(15 * time.Minute),
+		LoginPersist:       true,
+	}
+}
+
+// fileMode is an os.FileMode written in octal, e.g. "0777".
+type fileMode os.FileMode
+
+func (m *fileMode) String() string {
+	return "0" + strconv.FormatUint(uint64(*m), 8)
+}
+
+func (m *fileMode) Set(s string) error {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return err
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+func (m *fileMode) UnmarshalText(b []byte) error {
+	return m.Set(string(b))
+}
+
+// duration is a time.Duration written like "10s".
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalText(b []byte) error {
+	return d.Set(string(b))
+}
+
+func (c *Config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.String("config", "", "JSON config file")
+	fs.StringVar(&c.DSN, "dsn", c.DSN, "MySQL DSN")
+	fs.IntVar(&c.MaxOpenConns, "max-open-conns", c.MaxOpenConns, "maximum open DB connections (0 is unlimited)")
+	fs.IntVar(&c.MaxIdleConns, "max-idle-conns", c.MaxIdleConns, "maximum idle DB connections")
+	fs.StringVar(&c.HTTPAddr, "http-addr", c.HTTPAddr, "HTTP listen address (empty to disable)")
+	fs.StringVar(&c.DebugAddr, "debug-addr", c.DebugAddr, "pprof listen address (empty to disable)")
+	fs.StringVar(&c.UnixSocket, "unix-socket", c.UnixSocket, "unix socket path (empty to disable)")
+	fs.Var(&c.UnixSocketMode, "unix-socket-mode", "unix socket permissions")
+	fs.StringVar(&c.TemplateDir, "template-dir", c.TemplateDir, "template directory")
+	fs.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "static file directory")
+	fs.StringVar(&c.SessionSecret, "session-secret", c.SessionSecret, "session cookie secret")
+	fs.IntVar(&c.PasswordIterations, "password-iterations", c.PasswordIterations, "PBKDF2 iterations for new password hashes")
+	fs.Var(&c.ShutdownTimeout, "shutdown-timeout", "how long to wait for in-flight requests on shutdown")
+	fs.StringVar(&c.UpgradeBinary, "upgrade-binary", c.UpgradeBinary, "binary started on SIGUSR2 to take over the listeners (default: this one)")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format: logfmt or json")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum log level: debug, info, warn or error")
+	fs.BoolVar(&c.AccessLog, "access-log", c.AccessLog, "write an access log line per request")
+	fs.Var(&c.LoginWindow, "login-window", "how far back failed logins are counted")
+	fs.IntVar(&c.LoginMaxPerEmail, "login-max-per-email", c.LoginMaxPerEmail, "failed logins per email within login-window before lockout")
+	fs.IntVar(&c.LoginMaxPerIP, "login-max-per-ip", c.LoginMaxPerIP, "failed logins per IP within login-window before lockout")
+	fs.Var(&c.LoginLockout, "login-lockout", "how long logins are refused after too many failures")
+	fs.BoolVar(&c.LoginPersist, "login-persist", c.LoginPersist, "record failed logins in login_failures, so that limits survive restarts")
+	fs.BoolVar(&c.Dev, "dev", c.Dev, "development mode; allows the default session secret")
+	return fs
+}
+
+func envName(flagName string) string {
+	return "ISUXI_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func loadConfig(args []string) (Config, error) {
+	c := defaultConfig()
+	fs := c.flagSet()
+	fs.Parse(args)
+
+	// The flag set writes into c, so remember what was given on the command
+	// line and reapply it after the file and environment.
+	given := map[string]string{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = f.Value.String() })
+	c = defaultConfig()
+
+	path, ok := given["config"]
+	if !ok {
+		path = os.Getenv(envName("config"))
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return c, err
+		}
+		err = json.NewDecoder(f).Decode(&c)
+		f.Close()
+		if err != nil {
+			return c, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	if v := os.Getenv("ISUCON5_SESSION_SECRET"); v != "" {
+		c.SessionSecret = v
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok && err == nil && f.Name != "config" {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%s: %v", envName(f.Name), e)
+			}
+		}
+	})
+	if err != nil {
+		return c, err
+	}
+	for name, v := range given {
+		fs.Set(name, v)
+	}
+
+	if c.SessionSecret == "" || c.SessionSecret == defaultSessionSecret {
+		if !c.Dev {
+			return c, fmt.Errorf("refusing to start with the default session secret; set ISUCON5_SESSION_SECRET or use -dev")
+		}
+		c.SessionSecret = defaultSessionSecret
+	}
+	if c.LoginMaxPerEmail < 1 || c.LoginMaxPerIP < 1 {
+		return c, fmt.Errorf("login-max-per-email and login-max-per-ip must be positive")
+	}
+	if c.PasswordIterations < 1 {
+		return c, fmt.Errorf("password-iterations must be positive")
+	}
+	return c, nil
+}
+
+func mustLoadConfig() {
+	var err error
+	config, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := initLogging(os.Stderr, config.LogFormat, config.LogLevel); err != nil {
+		log.Fatal(err)
+	}
+	passwordIterations = config.PasswordIterations
+	dummyPasshash = hashPassword("")
+}
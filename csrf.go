@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// Every form carries the session's CSRF token in a hidden csrf_token field,
+// and withCSRF refuses state-changing requests without it. API requests that
+// aren't authenticated by the session cookie are exempt, since there is
+// nothing to forge; API clients that do use the cookie send the token in the
+// X-CSRF-Token header.
+
+const csrfSessionKey = "csrf_token"
+
+var ErrCSRF = &HTTPError{Status: http.StatusForbidden, Message: "不正なリクエストです。ページを再読み込みしてからもう一度お試しください"}
+
+// Page is embedded in the data of every template that includes the header.
+// render fills it in when the data is a pointer.
+type Page struct {
+	CSRFToken string
+	Viewer    *User
+	Unread    int // the viewer's unread notifications
+}
+
+func (p *Page) setPage(pg Page) { *p = pg }
+
+type pageSetter interface {
+	setPage(Page)
+}
+
+// csrfToken returns the session's CSRF token, creating one if needed. It
+// must be called before the response is started, since it may save the
+// session.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	session := getSession(w, r)
+	if t, ok := session.Values[csrfSessionKey].(string); ok && t != "" {
+		return t
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	t := hex.EncodeToString(b)
+	session.Values[csrfSessionKey] = t
+	checkErr(session.Save(r, w))
+	return t
+}
+
+func validCSRF(w http.ResponseWriter, r *http.Request) bool {
+	session := getSession(w, r)
+	want, _ := session.Values[csrfSessionKey].(string)
+	if want == "" {
+		return false
+	}
+	got := r.Header.Get("X-CSRF-Token")
+	if got == "" {
+		got = r.FormValue("csrf_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
+
+func safeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+func csrfExempt(r *http.Request) bool {
+	if !isAPIRequest(r) {
+		return false
+	}
+	if _, bearer := bearerToken(r); bearer {
+		return true
+	}
+	return sessionUserID(r) == 0
+}
+
+func withCSRF(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !safeMethod(r.Method) && !csrfExempt(r) && !validCSRF(w, r) {
+			handleError(w, r, ErrCSRF)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// querier is either *sql.DB or *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// dbQuery, dbQueryRow and dbExec run a query on q and record its timing
+// under name, a short label like "entries.list" identifying the query
+// whatever its arguments. Errors are logged with ctx, and so with the
+// request ID.
+func dbQuery(ctx context.Context, q querier, name, query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args...)
+	observeQuery(ctx, name, start, err)
+	return rows, err
+}
+
+func dbQueryRow(ctx context.Context, q querier, name, query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := q.QueryRowContext(ctx, query, args...)
+	observeQuery(ctx, name, start, row.Err())
+	return row
+}
+
+func dbExec(ctx context.Context, q querier, name, query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := q.ExecContext(ctx, query, args...)
+	observeQuery(ctx, name, start, err)
+	return result, err
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
 	"sync"
-	"time"
 )
 
 type EntryCache struct {
@@ -13,22 +17,21 @@ type EntryCache struct {
 
 var entryCache EntryCache
 
-func (cc *EntryCache) Init() {
+func (cc *EntryCache) Init(ctx context.Context) {
+	entryStats.invalidate()
 	cc.Lock()
 	defer cc.Unlock()
 
-	rows, err := db.Query(`SELECT id, user_id, private, title, created_at FROM entries2 ORDER BY created_at DESC LIMIT 1000`)
+	rows, err := dbQuery(ctx, db, "entries.cache_init", `SELECT id, user_id, private, list_id, title, created_at FROM entries2 ORDER BY created_at DESC, id DESC LIMIT 1000`)
 	if err != sql.ErrNoRows {
 		checkErr(err)
 	}
 	defer rows.Close()
 	entries := make([]Entry, 0, 1000)
 	for rows.Next() {
-		var id, userID, private int
-		var title string
-		var createdAt time.Time
-		checkErr(rows.Scan(&id, &userID, &private, &title, &createdAt))
-		entries = append(entries, Entry{ID: id, UserID: userID, Private: private == 1, Title: title, CreatedAt: createdAt})
+		var e Entry
+		checkErr(rows.Scan(&e.ID, &e.UserID, &e.Audience, &e.ListID, &e.Title, &e.CreatedAt))
+		entries = append(entries, e)
 	}
 	cc.Recent = entries
 
@@ -47,8 +50,133 @@ func (cc *EntryCache) Insert(e Entry) {
 	}
 }
 
+// Update replaces a cached entry. Readers iterate the slice returned by Get
+// without the lock, so modifications are made on a copy.
+func (cc *EntryCache) Update(e Entry) {
+	entryStats.invalidate()
+	cc.Lock()
+	defer cc.Unlock()
+	for i := range cc.Recent {
+		if cc.Recent[i].ID == e.ID {
+			recent := make([]Entry, len(cc.Recent))
+			copy(recent, cc.Recent)
+			e.Content = ""
+			recent[i] = e
+			cc.Recent = recent
+			return
+		}
+	}
+}
+
+func (cc *EntryCache) Remove(id int) {
+	entryStats.invalidate()
+	cc.Lock()
+	defer cc.Unlock()
+	recent := make([]Entry, 0, len(cc.Recent))
+	for _, e := range cc.Recent {
+		if e.ID != id {
+			recent = append(recent, e)
+		}
+	}
+	cc.Recent = recent
+}
+
 func (cc *EntryCache) Get() []Entry {
 	cc.Lock()
 	defer cc.Unlock()
 	return cc.Recent
 }
+
+// EntryCacheReport describes how the cache differs from the newest rows of
+// entries2. Only rows from the oldest cached entry on, by (created_at, id),
+// are compared.
+type EntryCacheReport struct {
+	Cached   int   `json:"cached"`
+	Checked  int   `json:"checked"`
+	Missing  []int `json:"missing"`  // in entries2 but not cached
+	Stale    []int `json:"stale"`    // cached but deleted from entries2
+	Modified []int `json:"modified"` // cached with different user, audience, title or time
+	Repaired bool  `json:"repaired"`
+}
+
+func (r *EntryCacheReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Stale) == 0 && len(r.Modified) == 0
+}
+
+// Check compares the cache with entries2 and, if repair is set and drift was
+// found, reloads the cache.
+func (cc *EntryCache) Check(ctx context.Context, repair bool) EntryCacheReport {
+	cached := cc.Get()
+	var rows *sql.Rows
+	var err error
+	if len(cached) > 0 {
+		// The cache holds the newest entries in (created_at, id) order, so
+		// every row from its oldest one on should be in it. Rows that share
+		// that entry's second but come before it are not.
+		oldest := cached[0]
+		rows, err = dbQuery(ctx, db, "entries.cache_check", `SELECT id, user_id, private, list_id, title, created_at FROM entries2 WHERE created_at > ? OR (created_at = ? AND id >= ?)`,
+			oldest.CreatedAt, oldest.CreatedAt, oldest.ID)
+	} else {
+		rows, err = dbQuery(ctx, db, "entries.cache_check", `SELECT id, user_id, private, list_id, title, created_at FROM entries2 ORDER BY created_at DESC, id DESC LIMIT 1000`)
+	}
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	stored := make(map[int]Entry, 1000)
+	for rows.Next() {
+		var e Entry
+		checkErr(rows.Scan(&e.ID, &e.UserID, &e.Audience, &e.ListID, &e.Title, &e.CreatedAt))
+		stored[e.ID] = e
+	}
+	rows.Close()
+
+	report := EntryCacheReport{Cached: len(cached), Checked: len(stored)}
+	seen := make(map[int]bool, len(cached))
+	for _, c := range cached {
+		seen[c.ID] = true
+		s, ok := stored[c.ID]
+		switch {
+		case !ok:
+			report.Stale = append(report.Stale, c.ID)
+		case s.UserID != c.UserID || s.Audience != c.Audience || s.ListID != c.ListID || s.Title != c.Title || !s.CreatedAt.Equal(c.CreatedAt):
+			report.Modified = append(report.Modified, c.ID)
+		}
+	}
+	for id := range stored {
+		if !seen[id] {
+			report.Missing = append(report.Missing, id)
+		}
+	}
+	sort.Ints(report.Missing)
+
+	if repair && !report.OK() {
+		cc.Init(ctx)
+		report.Repaired = true
+	}
+	return report
+}
+
+func init() {
+	// Served on the internal pprof listener, not the public router. GET only
+	// reports; POST also repairs, so that crawlers and prefetching can't
+	// reload the cache.
+	http.HandleFunc("/debug/entrycache", func(w http.ResponseWriter, r *http.Request) {
+		var repair bool
+		switch r.Method {
+		case "GET", "HEAD":
+		case "POST":
+			repair = true
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report := entryCache.Check(r.Context(), repair)
+		if !report.OK() {
+			slog.WarnContext(r.Context(), "entryCache drift", "missing", report.Missing, "stale", report.Stale,
+				"modified", report.Modified, "repaired", report.Repaired)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
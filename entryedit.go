@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// EntryRevision is a snapshot of an entry taken just before it was edited.
+type EntryRevision struct {
+	ID        int
+	EntryID   int
+	Audience  Audience
+	ListID    int
+	Title     string
+	Content   string
+	CreatedAt time.Time
+}
+
+func (rev EntryRevision) AudienceLabel() string {
+	return audienceLabel(rev.Audience, rev.ListID)
+}
+
+func fetchEntry(ctx context.Context, entryID int) *Entry {
+	row := dbQueryRow(ctx, db, "entries.fetch", `SELECT id, user_id, private, list_id, comment_policy, title, body, created_at FROM entries2 WHERE id = ?`, entryID)
+	e := Entry{}
+	err := row.Scan(&e.ID, &e.UserID, &e.Audience, &e.ListID, &e.CommentPolicy, &e.Title, &e.Content, &e.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	checkErr(err)
+	return &e
+}
+
+func fetchRevisions(ctx context.Context, entryID int) []EntryRevision {
+	rows, err := dbQuery(ctx, db, "entry_revisions.list", `SELECT id, entry_id, private, list_id, title, body, created_at FROM entry_revisions WHERE entry_id = ? ORDER BY id DESC`, entryID)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	defer rows.Close()
+	revs := make([]EntryRevision, 0, 10)
+	for rows.Next() {
+		rev := EntryRevision{}
+		checkErr(rows.Scan(&rev.ID, &rev.EntryID, &rev.Audience, &rev.ListID, &rev.Title, &rev.Content, &rev.CreatedAt))
+		revs = append(revs, rev)
+	}
+	return revs
+}
+
+// ownEntry loads the entry named in the URL and checks that it belongs to the
+// current user.
+func ownEntry(w http.ResponseWriter, r *http.Request) (*Entry, error) {
+	entryID, _ := strconv.Atoi(mux.Vars(r)["entry_id"])
+	entry := fetchEntry(r.Context(), entryID)
+	if entry == nil {
+		return nil, ErrContentNotFound
+	}
+	if entry.UserID != getCurrentUser(w, r).ID {
+		return nil, Forbidden("自分の日記しか編集できません")
+	}
+	return entry, nil
+}
+
+func PostEntryEdit(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	old, err := ownEntry(w, r)
+	if err != nil {
+		return err
+	}
+	entry := *old
+	entry.Title = r.FormValue("title")
+	if entry.Title == "" {
+		entry.Title = "タイトルなし"
+	}
+	entry.Content = r.FormValue("content")
+	entry.Audience, entry.ListID, err = formAudience(r, entry.UserID)
+	if err != nil {
+		return err
+	}
+	entry.CommentPolicy, err = parseCommentPolicy(r.FormValue("comment_policy"))
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	checkErr(err)
+	_, err = dbExec(r.Context(), tx, "entry_revisions.insert", `INSERT INTO entry_revisions (entry_id, private, list_id, title, body) VALUES (?,?,?,?,?)`,
+		old.ID, old.Audience, old.ListID, old.Title, old.Content)
+	if err == nil {
+		_, err = dbExec(r.Context(), tx, "entries.update", `UPDATE entries2 SET private = ?, list_id = ?, comment_policy = ?, title = ?, body = ? WHERE id = ?`,
+			entry.Audience, entry.ListID, entry.CommentPolicy, entry.Title, entry.Content, entry.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return Internal(err)
+	}
+	checkErr(tx.Commit())
+
+	// Only users newly mentioned by this edit are told about it.
+	mentioned := make(map[int]bool)
+	for _, u := range mentionedUsers(old.Content) {
+		mentioned[u.ID] = true
+	}
+	notifyMentions(r.Context(), entry, entry.UserID, entry.Content, 0, mentioned)
+
+	entryCache.Update(entry)
+	searchIndex.UpdateEntry(*old, entry)
+	if entry.Audience != old.Audience || entry.ListID != old.ListID {
+		commentCache.SetEntryAudience(entry.ID, entry.Audience, entry.ListID)
+	}
+	http.Redirect(w, r, "/diary/entry/"+strconv.Itoa(entry.ID), http.StatusSeeOther)
+	return nil
+}
+
+func PostEntryDelete(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	entry, err := ownEntry(w, r)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	checkErr(err)
+	unread, err := deleteNotifications(r.Context(), tx, `entry_id = ?`, entry.ID)
+	if err != nil {
+		tx.Rollback()
+		return Internal(err)
+	}
+	for _, q := range []string{
+		`DELETE FROM comments WHERE entry_id = ?`,
+		`DELETE FROM entry_revisions WHERE entry_id = ?`,
+		`DELETE FROM entries2 WHERE id = ?`,
+	} {
+		if _, err := dbExec(r.Context(), tx, "entries.delete", q, entry.ID); err != nil {
+			tx.Rollback()
+			return Internal(err)
+		}
+	}
+	checkErr(tx.Commit())
+
+	notificationRepo.Forget(unread)
+	entryCache.Remove(entry.ID)
+	commentCache.RemoveEntry(entry.ID)
+	searchIndex.RemoveEntry(entry.ID)
+	http.Redirect(w, r, "/diary/entries/"+getCurrentUser(w, r).AccountName, http.StatusSeeOther)
+	return nil
+}
+
+// GetEntryRevisions lists the previous versions of an entry to its owner. Old
+// versions may have had a wider audience or text since removed, so no one
+// else sees them. When rev is given, it also shows what changed between that
+// revision and the version after it.
+func GetEntryRevisions(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	entryID, _ := strconv.Atoi(mux.Vars(r)["entry_id"])
+	entry := fetchEntry(r.Context(), entryID)
+	if entry == nil {
+		return ErrContentNotFound
+	}
+	if entry.UserID != getCurrentUser(w, r).ID {
+		return ErrPermissionDenied
+	}
+
+	revs := fetchRevisions(r.Context(), entry.ID)
+	var selected, next *EntryRevision
+	var diff []DiffLine
+	if revID, err := strconv.Atoi(r.FormValue("rev")); err == nil {
+		for i := range revs {
+			if revs[i].ID != revID {
+				continue
+			}
+			selected = &revs[i]
+			if i > 0 {
+				next = &revs[i-1]
+			} else {
+				next = &EntryRevision{EntryID: entry.ID, Audience: entry.Audience, ListID: entry.ListID, Title: entry.Title, Content: entry.Content}
+			}
+			diff = diffLines(strings.Split(selected.Content, "\n"), strings.Split(next.Content, "\n"))
+			break
+		}
+	}
+
+	render(w, r, http.StatusOK, "revisions.html", &struct {
+		Page
+		Owner     *User
+		Entry     *Entry
+		Revisions []EntryRevision
+		Selected  *EntryRevision
+		Next      *EntryRevision
+		Diff      []DiffLine
+	}{Page{}, getUser(entry.UserID), entry, revs, selected, next, diff})
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// HTTPError is an error a handler returns to have an error page rendered
+// with the given status. Cause, if any, is logged but never shown.
+type HTTPError struct {
+	Status  int
+	Message string
+	Cause   error
+}
+
+func (e *HTTPError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%d %s: %v", e.Status, e.Message, e.Cause)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+var (
+	ErrContentNotFound  = &HTTPError{Status: http.StatusNotFound, Message: "要求されたコンテンツは存在しません"}
+	ErrPermissionDenied = &HTTPError{Status: http.StatusForbidden, Message: "友人のみしかアクセスできません"}
+)
+
+func Forbidden(message string) error {
+	return &HTTPError{Status: http.StatusForbidden, Message: message}
+}
+
+func Conflict(message string) error {
+	return &HTTPError{Status: http.StatusConflict, Message: message}
+}
+
+func Internal(cause error) error {
+	return &HTTPError{Status: http.StatusInternalServerError, Message: "サーバーエラーが発生しました", Cause: cause}
+}
+
+// requestState is per-request data shared between the middleware and the
+// handlers. It is stored in the request context by withRecovery.
+type requestState struct {
+	id         string
+	route      string
+	matched    bool
+	user       *User
+	userLoaded bool
+	token      *APIToken
+	session    *sessions.Session
+}
+
+type requestStateKey struct{}
+
+func reqState(r *http.Request) *requestState {
+	if st, ok := r.Context().Value(requestStateKey{}).(*requestState); ok {
+		return st
+	}
+	return &requestState{}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts IDs set by the reverse proxy, as long as they are
+// safe to write into logs as is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// statusWriter remembers whether the response has been started, so that the
+// recovery middleware knows if it can still send an error page, and how much
+// was written for the access log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// withRecovery assigns a request ID and turns panics from handlers into
+// logged 500 responses instead of dropped connections. It also writes the
+// access log and records the request metrics, after any error page has been
+// written.
+func withRecovery(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &requestState{id: r.Header.Get("X-Request-Id"), route: r.Method + " " + r.URL.Path}
+		if !validRequestID(st.id) {
+			st.id = newRequestID()
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestStateKey{}, st))
+		sw := &statusWriter{ResponseWriter: w}
+		sw.Header().Set("X-Request-Id", st.id)
+
+		start := time.Now()
+		defer func() {
+			d := time.Since(start)
+			observeRequest(st, sw.status, d)
+			logAccess(r, st, sw, d)
+		}()
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			err, ok := rec.(error)
+			if !ok {
+				err = fmt.Errorf("%v", rec)
+			}
+			if _, typed := err.(*HTTPError); !typed {
+				err = Internal(err)
+			}
+			slog.ErrorContext(r.Context(), "panic", "route", st.route, "user_id", userIDOf(st.user), "err", err, "stack", string(debug.Stack()))
+			if sw.status != 0 {
+				return
+			}
+			handleError(sw, r, err)
+		}()
+		h.ServeHTTP(sw, r)
+	})
+}
+
+func userIDOf(u *User) int {
+	if u == nil {
+		return 0
+	}
+	return u.ID
+}
+
+// handleError renders the error page for err, or a JSON error body for API
+// requests. Errors that aren't an *HTTPError are treated as internal errors.
+func handleError(w http.ResponseWriter, r *http.Request, err error) {
+	he, ok := err.(*HTTPError)
+	if !ok {
+		he = Internal(err).(*HTTPError)
+	}
+	st := reqState(r)
+	level := slog.LevelDebug
+	if he.Status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.Log(r.Context(), level, "request failed", "route", st.route, "user_id", userIDOf(st.user), "status", he.Status, "err", he)
+	if isAPIRequest(r) {
+		writeAPIError(w, he)
+		return
+	}
+	render(w, r, he.Status, "error.html", &struct {
+		Page
+		Message string
+	}{Message: he.Message})
+}
+
+// appHandler adapts a handler that returns an error. route is the pattern it
+// was registered with, recorded for logging and metrics. scope is what an API
+// token needs to be used on the route; with no scope, tokens are refused.
+type appHandler struct {
+	route string
+	scope string
+	fn    func(http.ResponseWriter, *http.Request) error
+}
+
+func (h appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st := reqState(r)
+	st.route = h.route
+	st.matched = true
+	if err := h.checkToken(r); err != nil {
+		handleError(w, r, err)
+		return
+	}
+	if err := h.fn(w, r); err != nil {
+		handleError(w, r, err)
+	}
+}
+
+func (h appHandler) checkToken(r *http.Request) error {
+	t, err := requestToken(r)
+	if err != nil || t == nil {
+		return err
+	}
+	if h.scope == "" || !t.HasScope(h.scope) {
+		return Forbidden("このトークンでは許可されていない操作です")
+	}
+	return nil
+}
+
+// handle registers fn for pattern on r. An empty method matches any method.
+func handle(r *mux.Router, method, pattern string, fn func(http.ResponseWriter, *http.Request) error) {
+	handleScoped(r, method, pattern, "", fn)
+}
+
+// handleScoped is handle for routes that API tokens with scope may use.
+func handleScoped(r *mux.Router, method, pattern, scope string, fn func(http.ResponseWriter, *http.Request) error) {
+	route := method + " " + pattern
+	if method == "" {
+		route = pattern
+	}
+	rt := r.Handle(pattern, appHandler{route, scope, fn})
+	if method != "" {
+		rt.Methods(method)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"sync"
 	"time"
 )
 
 type Footprint struct {
+	ID        int
 	UserID    int       // 踏まれた人
 	OwnerID   int       // 踏んだ人
 	CreatedAt time.Time // date
@@ -16,38 +18,77 @@ type Footprint struct {
 type FoopprintCache struct {
 	sync.Mutex
 	cache map[int][]Footprint
+	// fetch reads the newest limit footprints from the DB.
+	fetch func(ctx context.Context, userID, limit int) []Footprint
 }
 
-var footPrintCache = FoopprintCache{cache: make(map[int][]Footprint, 1024)}
+const (
+	footprintsPerPage = 50
+	// One more than a page, so that the first page can tell whether there
+	// is a next one.
+	footprintCacheSize = footprintsPerPage + 1
+)
+
+var footPrintCache = FoopprintCache{cache: make(map[int][]Footprint, 1024), fetch: fetchFootprint}
 
 func (c *FoopprintCache) Reset() {
+	footprintStats.invalidate()
 	c.Lock()
 	c.cache = make(map[int][]Footprint, 1024)
 	c.Unlock()
 }
 
-func (c *FoopprintCache) Get(userID int) []Footprint {
+func (c *FoopprintCache) get(ctx context.Context, userID int) []Footprint {
 	c.Lock()
 	defer c.Unlock()
 	if fps, ok := c.cache[userID]; ok {
+		footprintStats.hit()
 		return fps
 	}
+	footprintStats.miss()
 
-	fps := fetchFootprint(userID, 50)
+	fps := c.fetch(ctx, userID, footprintCacheSize)
 	c.cache[userID] = fps
 	return fps
 }
 
+// Recent returns up to n of the newest footprints left on userID's pages.
+// The result is a copy, so callers may keep or modify it regardless of
+// later invalidation.
+func (c *FoopprintCache) Recent(ctx context.Context, userID, n int) []Footprint {
+	if n <= 0 {
+		return []Footprint{}
+	}
+	if n > footprintCacheSize {
+		footprintStats.miss()
+		return c.fetch(ctx, userID, n)
+	}
+	fps := c.get(ctx, userID)
+	if len(fps) < n {
+		n = len(fps)
+	}
+	recent := make([]Footprint, n)
+	copy(recent, fps)
+	return recent
+}
+
 func (c *FoopprintCache) Invalidate(userID int) {
+	footprintStats.invalidate()
 	c.Lock()
 	delete(c.cache, userID)
 	c.Unlock()
 }
 
-func markFootprint(visitor, id int) {
-	if visitor != id {
+func (c *FoopprintCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.cache)
+}
+
+func markFootprint(ctx context.Context, visitor, id int) {
+	if visitor != id && !blockRepo.IsBlocked(id, visitor) {
 		now := time.Now()
-		_, err := db.Exec(`replace INTO footprints (user_id,owner_id,date,created_at) VALUES (?,?,?,?)`, id, visitor, now, now)
+		_, err := dbExec(ctx, db, "footprints.replace", `replace INTO footprints (user_id,owner_id,date,created_at) VALUES (?,?,?,?)`, id, visitor, now, now)
 		if err != nil {
 			panic(err)
 		}
@@ -55,20 +96,53 @@ func markFootprint(visitor, id int) {
 	}
 }
 
-func fetchFootprint(userID, limit int) []Footprint {
-	rows, err := db.Query(`SELECT user_id, owner_id, date, created_at
+// footprintedUsers returns the users whose pages visitorID has left
+// footprints on.
+func footprintedUsers(ctx context.Context, q querier, visitorID int) ([]int, error) {
+	rows, err := dbQuery(ctx, q, "footprints.visited", `SELECT DISTINCT user_id FROM footprints WHERE owner_id = ?`, visitorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func fetchFootprint(ctx context.Context, userID, limit int) []Footprint {
+	rows, err := dbQuery(ctx, db, "footprints.recent", `SELECT id, user_id, owner_id, date, created_at
 FROM footprints
 WHERE user_id = ?
-ORDER BY created_at DESC
+ORDER BY created_at DESC, id DESC
 LIMIT ?`, userID, limit)
 	if err != sql.ErrNoRows {
 		checkErr(err)
 	}
+	return scanFootprints(rows)
+}
+
+func fetchFootprintPage(ctx context.Context, userID int, pq pageQuery) []Footprint {
+	cond, args := pq.where("created_at", "id")
+	rows, err := dbQuery(ctx, db, "footprints.page", `SELECT id, user_id, owner_id, date, created_at FROM footprints WHERE user_id = ?`+cond+pq.orderLimit("created_at", "id"),
+		append([]interface{}{userID}, args...)...)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	return scanFootprints(rows)
+}
+
+func scanFootprints(rows *sql.Rows) []Footprint {
 	defer rows.Close()
 	footprints := make([]Footprint, 0, 10)
 	for rows.Next() {
 		fp := Footprint{}
-		checkErr(rows.Scan(&fp.UserID, &fp.OwnerID, &fp.CreatedAt, &fp.UpdatedAt))
+		checkErr(rows.Scan(&fp.ID, &fp.UserID, &fp.OwnerID, &fp.CreatedAt, &fp.UpdatedAt))
 		footprints = append(footprints, fp)
 	}
 	return footprints
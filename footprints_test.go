@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFootprints stands in for the footprints table in FoopprintCache.fetch.
+type fakeFootprints struct {
+	sync.Mutex
+	rows    map[int][]Footprint // per user, newest first
+	fetches int
+}
+
+func (f *fakeFootprints) fetch(ctx context.Context, userID, limit int) []Footprint {
+	f.Lock()
+	defer f.Unlock()
+	f.fetches++
+	rows := f.rows[userID]
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	// Each read gets fresh rows, as from the DB.
+	return append([]Footprint{}, rows...)
+}
+
+func (f *fakeFootprints) set(userID int, rows []Footprint) {
+	f.Lock()
+	f.rows[userID] = rows
+	f.Unlock()
+}
+
+func (f *fakeFootprints) count() int {
+	f.Lock()
+	defer f.Unlock()
+	return f.fetches
+}
+
+func newTestFootprintCache(rows map[int][]Footprint) (*FoopprintCache, *fakeFootprints) {
+	f := &fakeFootprints{rows: rows}
+	return &FoopprintCache{cache: make(map[int][]Footprint), fetch: f.fetch}, f
+}
+
+// makeFootprints returns n footprints left on userID's pages, newest first.
+func makeFootprints(userID, n int) []Footprint {
+	t := time.Date(2015, 9, 26, 12, 0, 0, 0, time.UTC)
+	fps := make([]Footprint, n)
+	for i := range fps {
+		fps[i] = Footprint{ID: n - i, UserID: userID, OwnerID: 1000 + i, CreatedAt: t, UpdatedAt: t.Add(-time.Duration(i) * time.Second)}
+	}
+	return fps
+}
+
+func TestFootprintCacheRecent(t *testing.T) {
+	tests := []struct {
+		name    string
+		stored  int // footprints on the user's pages
+		n       int
+		want    int
+		fetches int // after calling Recent twice
+	}{
+		{"negative", 10, -1, 0, 0},
+		{"zero", 10, 0, 0, 0},
+		{"empty", 0, 10, 0, 1},
+		{"short", 3, 10, 3, 1},
+		{"exact", 10, 10, 10, 1},
+		{"longer", 20, 10, 10, 1},
+		{"full", footprintCacheSize, footprintCacheSize, footprintCacheSize, 1},
+		{"full and longer", 2 * footprintCacheSize, footprintCacheSize, footprintCacheSize, 1},
+		{"beyond cache", 2 * footprintCacheSize, footprintCacheSize + 10, footprintCacheSize + 10, 2},
+		{"beyond cache and short", footprintCacheSize + 5, footprintCacheSize + 10, footprintCacheSize + 5, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const userID = 1
+			ctx := context.Background()
+			stored := makeFootprints(userID, tt.stored)
+			c, f := newTestFootprintCache(map[int][]Footprint{userID: stored})
+
+			got := c.Recent(ctx, userID, tt.n)
+			if got == nil {
+				t.Fatal("Recent returned nil")
+			}
+			if len(got) != tt.want {
+				t.Fatalf("Recent(%d) returned %d footprints, want %d", tt.n, len(got), tt.want)
+			}
+			for i := range got {
+				if got[i] != stored[i] {
+					t.Fatalf("footprint %d is %+v, want %+v", i, got[i], stored[i])
+				}
+			}
+
+			// The result is the caller's to modify.
+			if len(got) > 0 {
+				got[0].OwnerID = -1
+			}
+			again := c.Recent(ctx, userID, tt.n)
+			if len(again) > 0 && again[0] != stored[0] {
+				t.Errorf("modifying a result changed the cache: got %+v, want %+v", again[0], stored[0])
+			}
+			if n := f.count(); n != tt.fetches {
+				t.Errorf("fetched %d times, want %d", n, tt.fetches)
+			}
+		})
+	}
+}
+
+func TestFootprintCacheInvalidate(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestFootprintCache(map[int][]Footprint{1: makeFootprints(1, 3), 2: makeFootprints(2, 3)})
+	c.Recent(ctx, 1, 10)
+	c.Recent(ctx, 2, 10)
+
+	f.set(1, makeFootprints(1, 5))
+	f.set(2, makeFootprints(2, 5))
+	if got := c.Recent(ctx, 1, 10); len(got) != 3 {
+		t.Fatalf("got %d footprints before Invalidate, want the 3 cached", len(got))
+	}
+	c.Invalidate(1)
+	if got := c.Recent(ctx, 1, 10); len(got) != 5 {
+		t.Errorf("got %d footprints after Invalidate, want 5", len(got))
+	}
+	if got := c.Recent(ctx, 2, 10); len(got) != 3 {
+		t.Errorf("Invalidate(1) dropped user 2: got %d footprints, want the 3 cached", len(got))
+	}
+	c.Reset()
+	if got := c.Recent(ctx, 2, 10); len(got) != 5 {
+		t.Errorf("got %d footprints after Reset, want 5", len(got))
+	}
+	if n := f.count(); n != 4 {
+		t.Errorf("fetched %d times, want 4", n)
+	}
+}
+
+// TestFootprintCacheConcurrentInvalidation calls Recent while the cache is
+// invalidated and reset. Run it with -race.
+func TestFootprintCacheConcurrentInvalidation(t *testing.T) {
+	sizes := []int{0, 3, footprintCacheSize, 2 * footprintCacheSize}
+	rows := make(map[int][]Footprint)
+	for i, n := range sizes {
+		rows[i+1] = makeFootprints(i+1, n)
+	}
+	c, _ := newTestFootprintCache(rows)
+	ctx := context.Background()
+
+	var readers, writers sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if i == 0 && j%10 == 0 {
+					c.Reset()
+				} else {
+					c.Invalidate(j%len(sizes) + 1)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 8; i++ {
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+			for j := 0; j < 500; j++ {
+				userID := (i+j)%len(sizes) + 1
+				n := j%(footprintCacheSize+10) - 1
+				got := c.Recent(ctx, userID, n)
+				want := n
+				if stored := len(rows[userID]); want > stored {
+					want = stored
+				}
+				if want < 0 {
+					want = 0
+				}
+				if len(got) != want {
+					t.Errorf("Recent(%d, %d) returned %d footprints, want %d", userID, n, len(got), want)
+					return
+				}
+				for k := range got {
+					if got[k] != rows[userID][k] {
+						t.Errorf("Recent(%d, %d): footprint %d is %+v, want %+v", userID, n, k, got[k], rows[userID][k])
+						return
+					}
+				}
+				for k := range got {
+					got[k].OwnerID = -1
+				}
+			}
+		}(i)
+	}
+	readers.Wait()
+	close(stop)
+	writers.Wait()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+const maxFriendListNameLen = 64
+
+// FriendList is a named group of a user's friends, used as an entry
+// audience.
+type FriendList struct {
+	ID        int
+	UserID    int
+	Name      string
+	CreatedAt time.Time
+	Members   []int // sorted; filled in by ListsOf
+}
+
+type FriendListRepo struct {
+	sync.Mutex
+	lists   map[int]FriendList
+	members map[int]map[int]bool // list ID → member IDs
+}
+
+var friendListRepo = FriendListRepo{
+	lists:   make(map[int]FriendList, 1024),
+	members: make(map[int]map[int]bool, 1024),
+}
+
+func (fr *FriendListRepo) Init(ctx context.Context) {
+	fr.Lock()
+	defer fr.Unlock()
+	fr.lists = make(map[int]FriendList, 1024)
+	fr.members = make(map[int]map[int]bool, 1024)
+	rows, err := dbQuery(ctx, db, "friend_lists.init", `SELECT id, user_id, name, created_at FROM friend_lists`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	for rows.Next() {
+		var l FriendList
+		checkErr(rows.Scan(&l.ID, &l.UserID, &l.Name, &l.CreatedAt))
+		fr.lists[l.ID] = l
+	}
+	rows.Close()
+	rows, err = dbQuery(ctx, db, "friend_list_members.init", `SELECT list_id, user_id FROM friend_list_members`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	for rows.Next() {
+		var listID, userID int
+		checkErr(rows.Scan(&listID, &userID))
+		fr.addMember(listID, userID)
+	}
+	rows.Close()
+}
+
+func (fr *FriendListRepo) addMember(listID, userID int) {
+	m := fr.members[listID]
+	if m == nil {
+		m = make(map[int]bool)
+		fr.members[listID] = m
+	}
+	m[userID] = true
+}
+
+func (fr *FriendListRepo) Len() int {
+	fr.Lock()
+	defer fr.Unlock()
+	return len(fr.lists)
+}
+
+func (fr *FriendListRepo) Insert(l FriendList) {
+	fr.Lock()
+	fr.lists[l.ID] = l
+	fr.Unlock()
+}
+
+func (fr *FriendListRepo) Remove(listID int) {
+	fr.Lock()
+	delete(fr.lists, listID)
+	delete(fr.members, listID)
+	fr.Unlock()
+}
+
+func (fr *FriendListRepo) AddMember(listID, userID int) {
+	fr.Lock()
+	fr.addMember(listID, userID)
+	fr.Unlock()
+}
+
+func (fr *FriendListRepo) RemoveMember(listID, userID int) {
+	fr.Lock()
+	delete(fr.members[listID], userID)
+	fr.Unlock()
+}
+
+// RemovePair takes a and b off each other's lists, as when they stop being
+// friends.
+func (fr *FriendListRepo) RemovePair(a, b int) {
+	fr.Lock()
+	for id, l := range fr.lists {
+		switch l.UserID {
+		case a:
+			delete(fr.members[id], b)
+		case b:
+			delete(fr.members[id], a)
+		}
+	}
+	fr.Unlock()
+}
+
+func (fr *FriendListRepo) RemoveUser(userID int) {
+	fr.Lock()
+	for id, l := range fr.lists {
+		if l.UserID == userID {
+			delete(fr.lists, id)
+			delete(fr.members, id)
+		} else {
+			delete(fr.members[id], userID)
+		}
+	}
+	fr.Unlock()
+}
+
+func (fr *FriendListRepo) Get(listID int) *FriendList {
+	fr.Lock()
+	defer fr.Unlock()
+	l, ok := fr.lists[listID]
+	if !ok {
+		return nil
+	}
+	return &l
+}
+
+// IsMember reports whether userID is on ownerID's list listID.
+func (fr *FriendListRepo) IsMember(listID, ownerID, userID int) bool {
+	fr.Lock()
+	defer fr.Unlock()
+	return fr.lists[listID].UserID == ownerID && fr.members[listID][userID]
+}
+
+// ListsContaining returns the IDs of ownerID's lists that userID is on.
+func (fr *FriendListRepo) ListsContaining(ownerID, userID int) []int {
+	fr.Lock()
+	defer fr.Unlock()
+	var ids []int
+	for id, l := range fr.lists {
+		if l.UserID == ownerID && fr.members[id][userID] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// ListsOf returns userID's lists with their members, oldest first.
+func (fr *FriendListRepo) ListsOf(userID int) []FriendList {
+	fr.Lock()
+	lists := make([]FriendList, 0, 4)
+	for id, l := range fr.lists {
+		if l.UserID != userID {
+			continue
+		}
+		for m := range fr.members[id] {
+			l.Members = append(l.Members, m)
+		}
+		sort.Ints(l.Members)
+		lists = append(lists, l)
+	}
+	fr.Unlock()
+	sort.Slice(lists, func(i, j int) bool { return lists[i].ID < lists[j].ID })
+	return lists
+}
+
+// deleteListMemberships takes a and b off each other's lists in tx.
+func deleteListMemberships(ctx context.Context, tx *sql.Tx, a, b int) error {
+	_, err := dbExec(ctx, tx, "friend_list_members.delete_pair", `DELETE m FROM friend_list_members m JOIN friend_lists l ON m.list_id = l.id
+WHERE (l.user_id = ? AND m.user_id = ?) OR (l.user_id = ? AND m.user_id = ?)`, a, b, b, a)
+	return err
+}
+
+// ownList loads the list named in the URL and checks that it belongs to the
+// current user.
+func ownList(w http.ResponseWriter, r *http.Request) (*FriendList, error) {
+	id, _ := strconv.Atoi(mux.Vars(r)["list_id"])
+	l := friendListRepo.Get(id)
+	if l == nil || l.UserID != getCurrentUser(w, r).ID {
+		return nil, ErrContentNotFound
+	}
+	return l, nil
+}
+
+func GetFriendLists(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	render(w, r, http.StatusOK, "friend_lists.html", &struct {
+		Page
+		Lists   []FriendList
+		Friends []int
+	}{Page{}, friendListRepo.ListsOf(user.ID), friendRepo.FriendIDs(user.ID)})
+	return nil
+}
+
+func PostFriendList(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > maxFriendListNameLen {
+		return &HTTPError{Status: http.StatusBadRequest, Message: "リストの名前は1文字以上64文字以内で入力してください"}
+	}
+	l := FriendList{UserID: user.ID, Name: name, CreatedAt: time.Now().Truncate(time.Second)}
+	result, err := dbExec(r.Context(), db, "friend_lists.insert", `INSERT INTO friend_lists (user_id, name, created_at) VALUES (?,?,?)`, l.UserID, l.Name, l.CreatedAt)
+	checkErr(err)
+	id, _ := result.LastInsertId()
+	l.ID = int(id)
+	friendListRepo.Insert(l)
+	http.Redirect(w, r, "/lists", http.StatusSeeOther)
+	return nil
+}
+
+// PostFriendListDelete deletes a list. Entries shared with it become
+// visible to their owner only.
+func PostFriendListDelete(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	l, err := ownList(w, r)
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	checkErr(err)
+	_, err = dbExec(r.Context(), tx, "friend_list_members.delete_list", `DELETE FROM friend_list_members WHERE list_id = ?`, l.ID)
+	if err == nil {
+		_, err = dbExec(r.Context(), tx, "friend_lists.delete", `DELETE FROM friend_lists WHERE id = ?`, l.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return Internal(err)
+	}
+	checkErr(tx.Commit())
+	friendListRepo.Remove(l.ID)
+	http.Redirect(w, r, "/lists", http.StatusSeeOther)
+	return nil
+}
+
+func PostFriendListMember(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	l, err := ownList(w, r)
+	if err != nil {
+		return err
+	}
+	member := userRepo.GetByAccount(r.FormValue("account_name"))
+	if member == nil || !friendRepo.IsFriend(l.UserID, member.ID) || member.ID == l.UserID {
+		return Forbidden("リストには友だちしか追加できません")
+	}
+	_, err = dbExec(r.Context(), db, "friend_list_members.insert", `INSERT IGNORE INTO friend_list_members (list_id, user_id) VALUES (?,?)`, l.ID, member.ID)
+	checkErr(err)
+	friendListRepo.AddMember(l.ID, member.ID)
+	http.Redirect(w, r, "/lists", http.StatusSeeOther)
+	return nil
+}
+
+func PostFriendListMemberDelete(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	l, err := ownList(w, r)
+	if err != nil {
+		return err
+	}
+	member := userRepo.GetByAccount(mux.Vars(r)["account_name"])
+	if member == nil {
+		return ErrContentNotFound
+	}
+	_, err = dbExec(r.Context(), db, "friend_list_members.delete", `DELETE FROM friend_list_members WHERE list_id = ? AND user_id = ?`, l.ID, member.ID)
+	checkErr(err)
+	friendListRepo.RemoveMember(l.ID, member.ID)
+	http.Redirect(w, r, "/lists", http.StatusSeeOther)
+	return nil
+}
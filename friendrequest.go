@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type FriendRequest struct {
+	ID        int
+	From      int
+	To        int
+	CreatedAt time.Time
+}
+
+type FriendRequestRepo struct {
+	sync.Mutex
+	outgoing map[int]map[int]FriendRequest
+	incoming map[int]map[int]FriendRequest
+}
+
+var friendRequestRepo = FriendRequestRepo{
+	outgoing: make(map[int]map[int]FriendRequest, 1024),
+	incoming: make(map[int]map[int]FriendRequest, 1024),
+}
+
+func (fr *FriendRequestRepo) Init(ctx context.Context) {
+	fr.Lock()
+	defer fr.Unlock()
+	fr.outgoing = make(map[int]map[int]FriendRequest, 1024)
+	fr.incoming = make(map[int]map[int]FriendRequest, 1024)
+	rows, err := dbQuery(ctx, db, "friend_requests.init", `SELECT id, from_user_id, to_user_id, created_at FROM friend_requests`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	for rows.Next() {
+		var req FriendRequest
+		checkErr(rows.Scan(&req.ID, &req.From, &req.To, &req.CreatedAt))
+		fr.insert(req)
+	}
+	rows.Close()
+}
+
+func (fr *FriendRequestRepo) insert(req FriendRequest) {
+	out := fr.outgoing[req.From]
+	if out == nil {
+		out = make(map[int]FriendRequest)
+		fr.outgoing[req.From] = out
+	}
+	out[req.To] = req
+	in := fr.incoming[req.To]
+	if in == nil {
+		in = make(map[int]FriendRequest)
+		fr.incoming[req.To] = in
+	}
+	in[req.From] = req
+}
+
+func (fr *FriendRequestRepo) Insert(req FriendRequest) {
+	fr.Lock()
+	fr.insert(req)
+	fr.Unlock()
+}
+
+func (fr *FriendRequestRepo) Remove(from, to int) {
+	fr.Lock()
+	delete(fr.outgoing[from], to)
+	delete(fr.incoming[to], from)
+	fr.Unlock()
+}
+
+func (fr *FriendRequestRepo) RemoveUser(id int) {
+	fr.Lock()
+	for to := range fr.outgoing[id] {
+		delete(fr.incoming[to], id)
+	}
+	for from := range fr.incoming[id] {
+		delete(fr.outgoing[from], id)
+	}
+	delete(fr.outgoing, id)
+	delete(fr.incoming, id)
+	fr.Unlock()
+}
+
+func (fr *FriendRequestRepo) Exists(from, to int) bool {
+	fr.Lock()
+	_, ok := fr.outgoing[from][to]
+	fr.Unlock()
+	return ok
+}
+
+func sortedRequests(m map[int]FriendRequest) []FriendRequest {
+	reqs := make([]FriendRequest, 0, len(m))
+	for _, req := range m {
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].CreatedAt.Equal(reqs[j].CreatedAt) {
+			return reqs[i].ID > reqs[j].ID
+		}
+		return reqs[i].CreatedAt.After(reqs[j].CreatedAt)
+	})
+	return reqs
+}
+
+func (fr *FriendRequestRepo) Incoming(id int) []FriendRequest {
+	fr.Lock()
+	defer fr.Unlock()
+	return sortedRequests(fr.incoming[id])
+}
+
+func (fr *FriendRequestRepo) Outgoing(id int) []FriendRequest {
+	fr.Lock()
+	defer fr.Unlock()
+	return sortedRequests(fr.outgoing[id])
+}
+
+func (fr *FriendRequestRepo) CountIncoming(id int) int {
+	fr.Lock()
+	c := len(fr.incoming[id])
+	fr.Unlock()
+	return c
+}
+
+// Relationship of the current user to the owner of a profile page.
+const (
+	FriendStateSelf     = "self"
+	FriendStateFriend   = "friend"
+	FriendStateOutgoing = "outgoing"
+	FriendStateIncoming = "incoming"
+	FriendStateNone     = "none"
+)
+
+func friendState(myID, anotherID int) string {
+	switch {
+	case myID == anotherID:
+		return FriendStateSelf
+	case friendRepo.IsFriend(myID, anotherID):
+		return FriendStateFriend
+	case friendRequestRepo.Exists(myID, anotherID):
+		return FriendStateOutgoing
+	case friendRequestRepo.Exists(anotherID, myID):
+		return FriendStateIncoming
+	}
+	return FriendStateNone
+}
+
+func acceptFriendRequest(ctx context.Context, from, to int) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	result, err := dbExec(ctx, tx, "friend_requests.accept", `DELETE FROM friend_requests WHERE from_user_id = ? AND to_user_id = ?`, from, to)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Already accepted, declined or cancelled by a concurrent request.
+		tx.Rollback()
+		friendRequestRepo.Remove(from, to)
+		return nil
+	}
+	_, err = dbExec(ctx, tx, "relations.insert", `INSERT INTO relations (one, another) VALUES (?,?), (?,?)`, from, to, to, from)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	friendRequestRepo.Remove(from, to)
+	friendRepo.Insert(from, to)
+	insertNotification(ctx, Notification{UserID: from, Kind: NotificationFriendAccepted, ActorID: to})
+	return nil
+}
+
+func deleteFriendRequest(ctx context.Context, from, to int) {
+	_, err := dbExec(ctx, db, "friend_requests.delete", `DELETE FROM friend_requests WHERE from_user_id = ? AND to_user_id = ?`, from, to)
+	checkErr(err)
+	friendRequestRepo.Remove(from, to)
+}
+
+// requestFriend sends a friend request from user to another, or accepts the
+// one another already sent.
+func requestFriend(ctx context.Context, user, another *User) error {
+	if another.Deactivated {
+		return ErrContentNotFound
+	}
+	if blockRepo.Between(user.ID, another.ID) {
+		return Forbidden("このユーザには友だちリクエストを送れません")
+	}
+	switch friendState(user.ID, another.ID) {
+	case FriendStateIncoming:
+		if err := acceptFriendRequest(ctx, another.ID, user.ID); err != nil {
+			return Internal(err)
+		}
+	case FriendStateNone:
+		now := time.Now()
+		result, err := dbExec(ctx, db, "friend_requests.insert", `INSERT IGNORE INTO friend_requests (from_user_id, to_user_id, created_at) VALUES (?,?,?)`, user.ID, another.ID, now)
+		checkErr(err)
+		lastID, _ := result.LastInsertId()
+		if lastID != 0 {
+			friendRequestRepo.Insert(FriendRequest{ID: int(lastID), From: user.ID, To: another.ID, CreatedAt: now})
+			insertNotification(ctx, Notification{UserID: another.ID, Kind: NotificationFriendRequest, ActorID: user.ID})
+		}
+	}
+	return nil
+}
+
+func PostFriends(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+
+	user := getCurrentUser(w, r)
+	another := getUserFromAccount(w, mux.Vars(r)["account_name"])
+	if another == nil {
+		return ErrContentNotFound
+	}
+	if err := requestFriend(r.Context(), user, another); err != nil {
+		return err
+	}
+	http.Redirect(w, r, "/profile/"+another.AccountName, http.StatusSeeOther)
+	return nil
+}
+
+func GetFriendRequests(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	render(w, r, http.StatusOK, "friend_requests.html", &struct {
+		Page
+		Incoming []FriendRequest
+		Outgoing []FriendRequest
+	}{Page{}, friendRequestRepo.Incoming(user.ID), friendRequestRepo.Outgoing(user.ID)})
+	return nil
+}
+
+// PostFriendRequestAction handles accept, decline and cancel. accept and
+// decline act on a request from the named user, cancel on one sent to them.
+func PostFriendRequestAction(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	vars := mux.Vars(r)
+	another := getUserFromAccount(w, vars["account_name"])
+	if another == nil {
+		return ErrContentNotFound
+	}
+	switch vars["action"] {
+	case "accept":
+		if err := acceptFriendRequest(r.Context(), another.ID, user.ID); err != nil {
+			return Internal(err)
+		}
+	case "decline":
+		deleteFriendRequest(r.Context(), another.ID, user.ID)
+	case "cancel":
+		deleteFriendRequest(r.Context(), user.ID, another.ID)
+	}
+	http.Redirect(w, r, "/friends/requests", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrWarmingUp = &HTTPError{Status: http.StatusServiceUnavailable, Message: "起動中です。しばらくしてから再度アクセスしてください"}
+
+// warmRepo is an in-memory repository loaded from the DB at startup and on
+// /initialize.
+type warmRepo struct {
+	name string
+	init func(context.Context)
+	size func() int
+}
+
+var warmRepos = []warmRepo{
+	{"friends", friendRepo.Init, friendRepo.Len},
+	{"friend_lists", friendListRepo.Init, friendListRepo.Len},
+	{"friend_requests", friendRequestRepo.Init, friendRequestRepo.Len},
+	{"blocks", blockRepo.Init, blockRepo.Len},
+	{"comments", commentCache.Init, commentCache.Len},
+	{"users", userRepo.Init, userRepo.Len},
+	{"entries", entryCache.Init, entryCache.Len},
+	{"search", searchIndex.Init, searchIndex.Len},
+	{"profiles", profileRepo.Init, profileRepo.Len},
+	{"api_tokens", apiTokenRepo.Init, apiTokenRepo.Len},
+	{"login_throttle", loginThrottle.Init, loginThrottle.Len},
+	{"sessions", sessionStore.Init, sessionStore.Len},
+	{"notifications", notificationRepo.Init, notificationRepo.Len},
+}
+
+type repoStatus struct {
+	Name        string    `json:"name"`
+	Size        int       `json:"size"`
+	LastInit    time.Time `json:"last_init"`
+	InitSeconds float64   `json:"init_seconds"`
+}
+
+var health struct {
+	sync.Mutex
+	started time.Time
+	ready   bool
+	readyAt time.Time
+	repos   map[string]repoStatus
+}
+
+func init() {
+	health.started = time.Now()
+	health.repos = make(map[string]repoStatus, len(warmRepos))
+
+	// Served on the internal pprof listener as well, so that they answer
+	// while the public listeners are still held by the previous process.
+	http.HandleFunc("/healthz", healthz)
+	http.HandleFunc("/readyz", readyz)
+	http.HandleFunc("/debug/status", debugStatus)
+}
+
+// initRepos (re)loads every repository in warmRepos, recording how long
+// each one took.
+func initRepos(ctx context.Context) {
+	for _, wr := range warmRepos {
+		start := time.Now()
+		wr.init(ctx)
+		d := time.Since(start)
+		st := repoStatus{Name: wr.name, Size: wr.size(), LastInit: start, InitSeconds: d.Seconds()}
+		health.Lock()
+		health.repos[wr.name] = st
+		health.Unlock()
+		slog.InfoContext(ctx, "loaded repo", "repo", wr.name, "size", st.Size, "duration", d)
+	}
+}
+
+func setReady() {
+	health.Lock()
+	health.ready = true
+	health.readyAt = time.Now()
+	health.Unlock()
+	slog.Info("ready", "startup", health.readyAt.Sub(health.started))
+}
+
+func isReady() bool {
+	health.Lock()
+	defer health.Unlock()
+	return health.ready
+}
+
+// connectDB blocks until the DB answers a ping.
+func connectDB() *sql.DB {
+	for {
+		d, err := sql.Open("mysql", config.DSN)
+		if err != nil {
+			slog.Warn("failed to open DB", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		err = d.Ping()
+		if err != nil {
+			slog.Warn("failed to connect to DB", "err", err)
+			d.Close()
+			time.Sleep(time.Second)
+			continue
+		}
+		d.SetMaxOpenConns(config.MaxOpenConns)
+		d.SetMaxIdleConns(config.MaxIdleConns)
+		return d
+	}
+}
+
+func pingDB(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+// withWarmup answers 503 to everything but the probes until the
+// repositories have been loaded.
+func withWarmup(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() && r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+			w.Header().Set("Retry-After", "1")
+			handleError(w, r, ErrWarmingUp)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// healthz reports that the process is up, whatever the state of the DB.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readyz reports whether the DB is reachable and every repository has been
+// loaded, i.e. whether the load balancer should send us traffic.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "warming up")
+		return
+	}
+	if err := pingDB(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "db: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func debugStatus(w http.ResponseWriter, r *http.Request) {
+	var st struct {
+		Started time.Time    `json:"started"`
+		Ready   bool         `json:"ready"`
+		ReadyAt *time.Time   `json:"ready_at,omitempty"`
+		DB      string       `json:"db"`
+		Repos   []repoStatus `json:"repos"`
+	}
+	health.Lock()
+	st.Started = health.started
+	st.Ready = health.ready
+	if st.Ready {
+		t := health.readyAt
+		st.ReadyAt = &t
+	}
+	for _, wr := range warmRepos {
+		if rs, ok := health.repos[wr.name]; ok {
+			st.Repos = append(st.Repos, rs)
+		} else {
+			st.Repos = append(st.Repos, repoStatus{Name: wr.name})
+		}
+	}
+	health.Unlock()
+
+	switch {
+	case !st.Ready:
+		st.DB = "unknown"
+	case pingDB(r.Context()) != nil:
+		st.DB = "down"
+	default:
+		st.DB = "up"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+func (fr *FriendRepo) Len() int {
+	fr.Lock()
+	defer fr.Unlock()
+	n := 0
+	for _, m := range fr.friend {
+		n += len(m)
+	}
+	return n
+}
+
+func (fr *FriendRequestRepo) Len() int {
+	fr.Lock()
+	defer fr.Unlock()
+	n := 0
+	for _, m := range fr.outgoing {
+		n += len(m)
+	}
+	return n
+}
+
+func (br *BlockRepo) Len() int {
+	br.Lock()
+	defer br.Unlock()
+	n := 0
+	for _, m := range br.blocked {
+		n += len(m)
+	}
+	return n
+}
+
+func (cc *CommentCache) Len() int {
+	cc.Lock()
+	defer cc.Unlock()
+	return len(cc.Recent)
+}
+
+func (cc *EntryCache) Len() int {
+	cc.Lock()
+	defer cc.Unlock()
+	return len(cc.Recent)
+}
+
+func (r *UserRepo) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.users)
+}
+
+func (r *ProfileRepo) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.profiles)
+}
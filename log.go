@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// contextHandler adds the request ID, if ctx carries one, to every record,
+// so that anything logged with a request's context can be correlated with
+// its access log line.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if st, ok := ctx.Value(requestStateKey{}).(*requestState); ok {
+		rec.AddAttrs(slog.String("request_id", st.id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// initLogging makes slog, and the standard log package through it, write
+// in the configured format and level.
+func initLogging(w io.Writer, format, level string) error {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("log-level: %v", err)
+	}
+	opts := &slog.HandlerOptions{Level: lv}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "logfmt", "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("log-format: unknown format %q", format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+// fatal logs at error level and exits.
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logAccess writes the access log line for a finished request.
+func logAccess(r *http.Request, st *requestState, sw *statusWriter, d time.Duration) {
+	if !config.AccessLog {
+		return
+	}
+	userID := userIDOf(st.user)
+	if !st.userLoaded {
+		userID = sessionUserID(r)
+	}
+	route := ""
+	if st.matched {
+		route = st.route
+	}
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "access",
+		slog.String("method", r.Method),
+		slog.String("route", route),
+		slog.String("path", r.URL.Path),
+		slog.Int("user_id", userID),
+		slog.Int("status", status),
+		slog.Int64("bytes", sw.bytes),
+		slog.Float64("duration_ms", float64(d)/float64(time.Millisecond)),
+		slog.String("remote", r.RemoteAddr),
+	)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"regexp"
+	"unicode/utf8"
+)
+
+// mentionRe matches an @account_name. Matches that follow or run into other
+// name characters, like those in e-mail addresses, are skipped by
+// findMentions.
+var mentionRe = regexp.MustCompile(`@([0-9A-Za-z_]{3,32})`)
+
+func isNameByte(b byte) bool {
+	return b == '_' || b == '.' || '0' <= b && b <= '9' || 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z'
+}
+
+type mention struct {
+	start, end int // of "@name" in the text
+	user       *User
+}
+
+// findMentions returns the mentions of active users in text, in order.
+func findMentions(text string) []mention {
+	var ms []mention
+	for _, loc := range mentionRe.FindAllStringSubmatchIndex(text, -1) {
+		start, end := loc[0], loc[1]
+		if start > 0 && isNameByte(text[start-1]) || end < len(text) && text[end] != '.' && isNameByte(text[end]) {
+			continue
+		}
+		if u := userRepo.GetByAccount(text[loc[2]:loc[3]]); u != nil && !u.Deactivated {
+			ms = append(ms, mention{start, end, u})
+		}
+	}
+	return ms
+}
+
+// mentionedUsers returns each user mentioned in text once.
+func mentionedUsers(text string) []*User {
+	seen := make(map[int]bool)
+	var users []*User
+	for _, m := range findMentions(text) {
+		if !seen[m.user.ID] {
+			seen[m.user.ID] = true
+			users = append(users, m.user)
+		}
+	}
+	return users
+}
+
+// linkMentions turns the mentions in HTML-escaped text into links to the
+// users' profiles. Escaping leaves account names and "@" as they are.
+func linkMentions(escaped string) string {
+	ms := findMentions(escaped)
+	if len(ms) == 0 {
+		return escaped
+	}
+	buf := make([]byte, 0, len(escaped)+len(ms)*32)
+	last := 0
+	for _, m := range ms {
+		buf = append(buf, escaped[last:m.start]...)
+		buf = append(buf, mentionLink(m.user)...)
+		last = m.end
+	}
+	buf = append(buf, escaped[last:]...)
+	return string(buf)
+}
+
+func mentionLink(u *User) string {
+	return `<a href="/profile/` + u.AccountName + `">@` + u.AccountName + `</a>`
+}
+
+// linkMentionsTruncated escapes text and links the mentions in it, like
+// mentionHTML, but if text is longer than max runes keeps only the first
+// keep of them, followed by "...". A mention the cut runs into is left as
+// text, since its remainder may name another user.
+func linkMentionsTruncated(text string, max, keep int) string {
+	cut := len(text)
+	if utf8.RuneCountInString(text) > max {
+		cut = 0
+		for i := 0; i < keep; i++ {
+			_, size := utf8.DecodeRuneInString(text[cut:])
+			cut += size
+		}
+	}
+	buf := make([]byte, 0, cut+8)
+	last := 0
+	for _, m := range findMentions(text) {
+		if m.end > cut {
+			break
+		}
+		buf = append(buf, template.HTMLEscapeString(text[last:m.start])...)
+		buf = append(buf, mentionLink(m.user)...)
+		last = m.end
+	}
+	buf = append(buf, template.HTMLEscapeString(text[last:cut])...)
+	if cut < len(text) {
+		buf = append(buf, "..."...)
+	}
+	return string(buf)
+}
+
+// mentionHTML escapes text and links the mentions in it, for templates.
+func mentionHTML(text string) template.HTML {
+	return template.HTML(linkMentions(template.HTMLEscapeString(text)))
+}
+
+// notifyMentions tells the users mentioned in text by actorID about it,
+// unless they are in notified or can't read entry. commentID is 0 for
+// mentions in the entry itself.
+func notifyMentions(ctx context.Context, entry Entry, actorID int, text string, commentID int, notified map[int]bool) {
+	for _, u := range mentionedUsers(text) {
+		if notified[u.ID] || !entry.visibleTo(u.ID) {
+			continue
+		}
+		notified[u.ID] = true
+		insertNotification(ctx, Notification{UserID: u.ID, Kind: NotificationMention, ActorID: actorID, EntryID: entry.ID, CommentID: commentID})
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Metrics are written in the Prometheus text format by hand, to avoid
+// pulling in the client library for a handful of series.
+
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// histogramVec is a set of histograms keyed by the value of a single label.
+type histogramVec struct {
+	sync.Mutex
+	name, help, label string
+	series            map[string]*histogram
+}
+
+func newHistogramVec(name, help, label string) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, series: make(map[string]*histogram)}
+}
+
+func (v *histogramVec) observe(label string, d time.Duration) {
+	v.Lock()
+	h := v.series[label]
+	if h == nil {
+		h = &histogram{}
+		v.series[label] = h
+	}
+	h.observe(d.Seconds())
+	v.Unlock()
+}
+
+func (v *histogramVec) write(w *bufio.Writer) {
+	v.Lock()
+	defer v.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name)
+	labels := make([]string, 0, len(v.series))
+	for l := range v.series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		h := v.series[l]
+		var cum uint64
+		for i, b := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"%s\"} %d\n", v.name, v.label, l, formatFloat(b), cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", v.name, v.label, l, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %s\n", v.name, v.label, l, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", v.name, v.label, l, h.count)
+	}
+}
+
+// counterVec is a set of counters keyed by the values of its labels.
+type counterVec struct {
+	sync.Mutex
+	name, help string
+	labels     []string
+	series     map[string]uint64 // label values joined by "\x00"
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, series: make(map[string]uint64)}
+}
+
+func (v *counterVec) inc(values ...string) {
+	v.Lock()
+	v.series[strings.Join(values, "\x00")]++
+	v.Unlock()
+}
+
+func (v *counterVec) write(w *bufio.Writer) {
+	v.Lock()
+	defer v.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		values := strings.Split(k, "\x00")
+		pairs := make([]string, len(values))
+		for i, val := range values {
+			pairs[i] = fmt.Sprintf("%s=%q", v.labels[i], val)
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", v.name, strings.Join(pairs, ","), v.series[k])
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var (
+	httpDuration = newHistogramVec("isuxi_http_request_duration_seconds", "Time spent serving requests, by route.", "route")
+	httpRequests = newCounterVec("isuxi_http_requests_total", "Requests served, by route and status code.", "route", "code")
+	dbDuration   = newHistogramVec("isuxi_db_query_duration_seconds", "Time spent in DB queries, by query name.", "query")
+	dbErrors     = newCounterVec("isuxi_db_query_errors_total", "Failed DB queries, by query name.", "query")
+)
+
+// observeRequest records a finished request. Requests that didn't match a
+// registered route are grouped together to keep the label set bounded.
+func observeRequest(st *requestState, status int, d time.Duration) {
+	route := "other"
+	if st.matched {
+		route = st.route
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	httpDuration.observe(route, d)
+	httpRequests.inc(route, strconv.Itoa(status))
+}
+
+func observeQuery(ctx context.Context, name string, start time.Time, err error) {
+	d := time.Since(start)
+	dbDuration.observe(name, d)
+	if err == nil {
+		return
+	}
+	if expectedDBError(err) {
+		slog.DebugContext(ctx, "query failed", "query", name, "duration", d, "err", err)
+		return
+	}
+	dbErrors.inc(name)
+	slog.ErrorContext(ctx, "query failed", "query", name, "duration", d, "err", err)
+}
+
+// expectedDBError reports whether err is one that callers handle as part of
+// normal operation, like the duplicate key signup answers with a message.
+func expectedDBError(err error) bool {
+	me, ok := err.(*mysql.MySQLError)
+	return ok && me.Number == mysqlErrDupKey
+}
+
+// cacheStats counts lookups and invalidations of an in-memory cache. A hit
+// is a lookup answered from memory; a miss is one that went to the DB, or
+// that the cache couldn't answer because it doesn't hold the key or held
+// too few rows.
+type cacheStats struct {
+	hits, misses, invalidations uint64
+}
+
+func (s *cacheStats) hit()        { atomic.AddUint64(&s.hits, 1) }
+func (s *cacheStats) miss()       { atomic.AddUint64(&s.misses, 1) }
+func (s *cacheStats) invalidate() { atomic.AddUint64(&s.invalidations, 1) }
+
+func (s *cacheStats) lookup(found bool) {
+	if found {
+		s.hit()
+	} else {
+		s.miss()
+	}
+}
+
+var (
+	footprintStats cacheStats
+	entryStats     cacheStats
+	commentStats   cacheStats
+	userStats      cacheStats
+	profileStats   cacheStats
+	friendStats    cacheStats
+)
+
+var cacheMetrics = []struct {
+	name  string
+	stats *cacheStats
+	size  func() int
+}{
+	{"footprints", &footprintStats, footPrintCache.Len},
+	{"entries", &entryStats, entryCache.Len},
+	{"comments", &commentStats, commentCache.Len},
+	{"users", &userStats, userRepo.Len},
+	{"profiles", &profileStats, profileRepo.Len},
+	{"friends", &friendStats, friendRepo.Len},
+}
+
+func writeCacheMetrics(w *bufio.Writer) {
+	series := []struct {
+		name, typ, help string
+		value           func(*cacheStats) uint64
+	}{
+		{"isuxi_cache_hits_total", "counter", "Cache lookups answered from memory.", func(s *cacheStats) uint64 { return atomic.LoadUint64(&s.hits) }},
+		{"isuxi_cache_misses_total", "counter", "Cache lookups that went to the DB or that the cache could not answer.", func(s *cacheStats) uint64 { return atomic.LoadUint64(&s.misses) }},
+		{"isuxi_cache_invalidations_total", "counter", "Cache entries invalidated, updated in place or reloaded.", func(s *cacheStats) uint64 { return atomic.LoadUint64(&s.invalidations) }},
+	}
+	for _, s := range series {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.typ)
+		for _, c := range cacheMetrics {
+			fmt.Fprintf(w, "%s{cache=%q} %d\n", s.name, c.name, s.value(c.stats))
+		}
+	}
+	fmt.Fprintf(w, "# HELP isuxi_cache_size Number of items held in the cache.\n# TYPE isuxi_cache_size gauge\n")
+	for _, c := range cacheMetrics {
+		fmt.Fprintf(w, "isuxi_cache_size{cache=%q} %d\n", c.name, c.size())
+	}
+}
+
+func writeDBStats(w *bufio.Writer) {
+	if !isReady() {
+		return
+	}
+	s := db.Stats()
+	gauges := []struct {
+		name, help string
+		value      int64
+	}{
+		{"isuxi_db_max_open_connections", "Configured maximum number of open connections.", int64(s.MaxOpenConnections)},
+		{"isuxi_db_open_connections", "Open connections, in use and idle.", int64(s.OpenConnections)},
+		{"isuxi_db_in_use_connections", "Connections currently in use.", int64(s.InUse)},
+		{"isuxi_db_idle_connections", "Idle connections.", int64(s.Idle)},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+	counters := []struct {
+		name, help string
+		value      string
+	}{
+		{"isuxi_db_wait_count_total", "Connections waited for.", strconv.FormatInt(s.WaitCount, 10)},
+		{"isuxi_db_wait_duration_seconds_total", "Time spent waiting for a connection.", formatFloat(s.WaitDuration.Seconds())},
+		{"isuxi_db_max_idle_closed_total", "Connections closed due to MaxIdleConns.", strconv.FormatInt(s.MaxIdleClosed, 10)},
+		{"isuxi_db_max_lifetime_closed_total", "Connections closed due to ConnMaxLifetime.", strconv.FormatInt(s.MaxLifetimeClosed, 10)},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", c.name, c.help, c.name, c.name, c.value)
+	}
+}
+
+func init() {
+	// Served on the internal pprof listener, not the public router.
+	http.HandleFunc("/metrics", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := bufio.NewWriter(rw)
+		httpDuration.write(w)
+		httpRequests.write(w)
+		dbDuration.write(w)
+		dbErrors.write(w)
+		writeDBStats(w)
+		writeCacheMetrics(w)
+		w.Flush()
+	})
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+)
+
+// Notification kinds, stored in notifications.kind.
+const (
+	NotificationComment        = "comment"         // a comment on the user's entry
+	NotificationReply          = "reply"           // a reply to the user's comment
+	NotificationFriendRequest  = "friend_request"  // a friend request to the user
+	NotificationFriendAccepted = "friend_accepted" // the user's friend request was accepted
+	NotificationMention        = "mention"         // the user was mentioned in an entry or comment
+)
+
+type Notification struct {
+	ID        int
+	UserID    int
+	Kind      string
+	ActorID   int
+	EntryID   int
+	CommentID int
+	CreatedAt time.Time
+	ReadAt    mysql.NullTime
+}
+
+// Message describes the notification for its recipient.
+func (n Notification) Message() string {
+	actor := getUser(n.ActorID)
+	switch n.Kind {
+	case NotificationComment:
+		return actor.NickName + "さんがあなたの日記にコメントしました"
+	case NotificationReply:
+		return actor.NickName + "さんがあなたのコメントに返信しました"
+	case NotificationFriendRequest:
+		return actor.NickName + "さんから友だちリクエストが届きました"
+	case NotificationFriendAccepted:
+		return actor.NickName + "さんが友だちリクエストを承認しました"
+	case NotificationMention:
+		return actor.NickName + "さんがあなたについて書きました"
+	}
+	return ""
+}
+
+// URL is the page the notification links to.
+func (n Notification) URL() string {
+	if n.CommentID != 0 {
+		return "/diary/entry/" + strconv.Itoa(n.EntryID) + "#comment-" + strconv.Itoa(n.CommentID)
+	}
+	if n.EntryID != 0 {
+		return "/diary/entry/" + strconv.Itoa(n.EntryID)
+	}
+	if n.Kind == NotificationFriendRequest {
+		return "/friends/requests"
+	}
+	return "/profile/" + getUser(n.ActorID).AccountName
+}
+
+// NotificationRepo keeps each user's number of unread notifications, for
+// the header of every page.
+type NotificationRepo struct {
+	sync.Mutex
+	unread map[int]int
+}
+
+var notificationRepo = NotificationRepo{unread: make(map[int]int, 1024)}
+
+func (nr *NotificationRepo) Init(ctx context.Context) {
+	nr.Lock()
+	defer nr.Unlock()
+	nr.unread = make(map[int]int, 1024)
+	rows, err := dbQuery(ctx, db, "notifications.init", `SELECT user_id, COUNT(*) FROM notifications WHERE read_at IS NULL GROUP BY user_id`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	for rows.Next() {
+		var userID, n int
+		checkErr(rows.Scan(&userID, &n))
+		nr.unread[userID] = n
+	}
+	rows.Close()
+}
+
+func (nr *NotificationRepo) Len() int {
+	nr.Lock()
+	defer nr.Unlock()
+	return len(nr.unread)
+}
+
+func (nr *NotificationRepo) Unread(userID int) int {
+	nr.Lock()
+	defer nr.Unlock()
+	return nr.unread[userID]
+}
+
+// Add changes userID's unread count by n.
+func (nr *NotificationRepo) Add(userID, n int) {
+	nr.Lock()
+	defer nr.Unlock()
+	nr.unread[userID] += n
+	if nr.unread[userID] <= 0 {
+		delete(nr.unread, userID)
+	}
+}
+
+// Forget subtracts the unread notifications deleteNotifications removed.
+func (nr *NotificationRepo) Forget(unread map[int]int) {
+	for userID, n := range unread {
+		nr.Add(userID, -n)
+	}
+}
+
+func (nr *NotificationRepo) RemoveUser(userID int) {
+	nr.Lock()
+	delete(nr.unread, userID)
+	nr.Unlock()
+}
+
+func insertNotification(ctx context.Context, n Notification) {
+	if n.UserID == n.ActorID || blockRepo.Between(n.UserID, n.ActorID) {
+		return
+	}
+	_, err := dbExec(ctx, db, "notifications.insert", `INSERT INTO notifications (user_id, kind, actor_id, entry_id, comment_id) VALUES (?,?,?,?,?)`,
+		n.UserID, n.Kind, n.ActorID, n.EntryID, n.CommentID)
+	checkErr(err)
+	notificationRepo.Add(n.UserID, 1)
+}
+
+// deleteNotifications deletes the notifications matching cond within tx. It
+// returns how many unread ones each user lost, to pass to
+// notificationRepo.Forget once tx commits.
+func deleteNotifications(ctx context.Context, tx *sql.Tx, cond string, args ...interface{}) (map[int]int, error) {
+	rows, err := dbQuery(ctx, tx, "notifications.unread_by_user", `SELECT user_id, COUNT(*) FROM notifications WHERE read_at IS NULL AND (`+cond+`) GROUP BY user_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	unread := make(map[int]int)
+	for rows.Next() {
+		var userID, n int
+		if err := rows.Scan(&userID, &n); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		unread[userID] = n
+	}
+	rows.Close()
+	_, err = dbExec(ctx, tx, "notifications.delete", `DELETE FROM notifications WHERE `+cond, args...)
+	return unread, err
+}
+
+// notifyComment tells the entry's owner about the comment c, the author of
+// parent about the reply and the users mentioned in it, if they can still
+// read the entry. Each user gets one notification.
+func notifyComment(ctx context.Context, entry Entry, c Comment, parent *Comment) {
+	notified := make(map[int]bool)
+	if parent != nil && entry.visibleTo(parent.UserID) {
+		insertNotification(ctx, Notification{UserID: parent.UserID, Kind: NotificationReply, ActorID: c.UserID, EntryID: entry.ID, CommentID: c.ID})
+		notified[parent.UserID] = true
+	}
+	if !notified[entry.UserID] {
+		insertNotification(ctx, Notification{UserID: entry.UserID, Kind: NotificationComment, ActorID: c.UserID, EntryID: entry.ID, CommentID: c.ID})
+		notified[entry.UserID] = true
+	}
+	notifyMentions(ctx, entry, c.UserID, c.Comment, c.ID, notified)
+}
+
+const notificationsPerPage = 50
+
+// fetchNotifications returns a page of userID's notifications, newest first.
+func fetchNotifications(ctx context.Context, userID int, pq pageQuery) ([]Notification, Pager) {
+	cond, args := pq.where("created_at", "id")
+	rows, err := dbQuery(ctx, db, "notifications.list", `SELECT id, user_id, kind, actor_id, entry_id, comment_id, created_at, read_at FROM notifications WHERE user_id = ?`+cond+pq.orderLimit("created_at", "id"),
+		append([]interface{}{userID}, args...)...)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	ns := make([]Notification, 0, pq.limit+1)
+	for rows.Next() {
+		var n Notification
+		checkErr(rows.Scan(&n.ID, &n.UserID, &n.Kind, &n.ActorID, &n.EntryID, &n.CommentID, &n.CreatedAt, &n.ReadAt))
+		ns = append(ns, n)
+	}
+	rows.Close()
+	fetched := len(ns)
+	ns = ns[:pq.keep(fetched)]
+	if pq.backward {
+		for i := 0; i < len(ns)/2; i++ {
+			ns[i], ns[len(ns)-1-i] = ns[len(ns)-1-i], ns[i]
+		}
+	}
+	var pager Pager
+	if len(ns) > 0 {
+		first, last := ns[0], ns[len(ns)-1]
+		pager = pq.pager(fetched, Cursor{first.CreatedAt, first.ID}, Cursor{last.CreatedAt, last.ID})
+	}
+	return ns, pager
+}
+
+func GetNotifications(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	ns, pager := fetchNotifications(r.Context(), user.ID, newPageQuery(r, notificationsPerPage, true))
+	render(w, r, http.StatusOK, "notifications.html", &struct {
+		Page
+		Notifications []Notification
+		Pager         Pager
+	}{Page{}, ns, pager})
+	return nil
+}
+
+// PostNotificationRead marks one of the user's notifications as read.
+func PostNotificationRead(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	id, _ := strconv.Atoi(mux.Vars(r)["notification_id"])
+	result, err := dbExec(r.Context(), db, "notifications.read", `UPDATE notifications SET read_at = NOW() WHERE id = ? AND user_id = ? AND read_at IS NULL`, id, user.ID)
+	checkErr(err)
+	if n, _ := result.RowsAffected(); n > 0 {
+		notificationRepo.Add(user.ID, -int(n))
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+	return nil
+}
+
+// PostNotificationsRead marks all of the user's notifications as read.
+func PostNotificationsRead(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	result, err := dbExec(r.Context(), db, "notifications.read_all", `UPDATE notifications SET read_at = NOW() WHERE user_id = ? AND read_at IS NULL`, user.ID)
+	checkErr(err)
+	if n, _ := result.RowsAffected(); n > 0 {
+		notificationRepo.Add(user.ID, -int(n))
+	}
+	http.Redirect(w, r, "/notifications", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursor is a keyset position: the (created_at, id) of the row at the edge of
+// a page. It is passed around as "<unix time>-<id>".
+type Cursor struct {
+	Time time.Time
+	ID   int
+}
+
+// before reports whether c comes before o in (created_at, id) order.
+func (c Cursor) before(o Cursor) bool {
+	return c.Time.Before(o.Time) || c.Time.Equal(o.Time) && c.ID < o.ID
+}
+
+func (c Cursor) String() string {
+	return strconv.FormatInt(c.Time.Unix(), 10) + "-" + strconv.Itoa(c.ID)
+}
+
+func parseCursor(s string) (Cursor, bool) {
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return Cursor{}, false
+	}
+	t, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return Cursor{}, false
+	}
+	id, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return Cursor{}, false
+	}
+	return Cursor{time.Unix(t, 0), id}, true
+}
+
+// Pager holds the links to the neighbouring pages, empty when there is no
+// such page.
+type Pager struct {
+	Prev template.URL
+	Next template.URL
+}
+
+// pageQuery describes one page of a list ordered by (created_at, id).
+// Lists shown newest first walk forward with ?before=, lists shown oldest
+// first with ?after=; the other parameter walks backward.
+type pageQuery struct {
+	limit     int
+	desc      bool
+	cursor    Cursor
+	hasCursor bool
+	backward  bool
+}
+
+func newPageQuery(r *http.Request, limit int, desc bool) pageQuery {
+	pq := pageQuery{limit: limit, desc: desc}
+	if c, ok := parseCursor(r.FormValue(pq.forwardParam())); ok {
+		pq.cursor, pq.hasCursor = c, true
+	} else if c, ok := parseCursor(r.FormValue(pq.backwardParam())); ok {
+		pq.cursor, pq.hasCursor, pq.backward = c, true, true
+	}
+	return pq
+}
+
+func (pq pageQuery) forwardParam() string {
+	if pq.desc {
+		return "before"
+	}
+	return "after"
+}
+
+func (pq pageQuery) backwardParam() string {
+	if pq.desc {
+		return "after"
+	}
+	return "before"
+}
+
+// descending reports whether rows are fetched newest first.
+func (pq pageQuery) descending() bool {
+	return pq.desc != pq.backward
+}
+
+// where returns the condition selecting rows past the cursor, prefixed with
+// " AND ", or "" for the first page.
+func (pq pageQuery) where(timeCol, idCol string) (string, []interface{}) {
+	if !pq.hasCursor {
+		return "", nil
+	}
+	op := ">"
+	if pq.descending() {
+		op = "<"
+	}
+	return fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND %s %s ?))", timeCol, op, timeCol, idCol, op),
+		[]interface{}{pq.cursor.Time, pq.cursor.Time, pq.cursor.ID}
+}
+
+// orderLimit returns the ORDER BY and LIMIT clauses. One extra row is fetched
+// to find out whether there is another page.
+func (pq pageQuery) orderLimit(timeCol, idCol string) string {
+	dir := "ASC"
+	if pq.descending() {
+		dir = "DESC"
+	}
+	return fmt.Sprintf(" ORDER BY %s %s, %s %s LIMIT %d", timeCol, dir, idCol, dir, pq.limit+1)
+}
+
+// keep returns how many of the n fetched rows belong to the page. When
+// walking backward, the caller must reverse them to restore list order.
+func (pq pageQuery) keep(n int) int {
+	if n > pq.limit {
+		return pq.limit
+	}
+	return n
+}
+
+// pager builds the links given the number of rows fetched and the cursors of
+// the first and last rows of the page in list order.
+func (pq pageQuery) pager(fetched int, first, last Cursor) Pager {
+	if fetched == 0 {
+		return Pager{}
+	}
+	more := fetched > pq.limit
+	forward, backward := more, pq.hasCursor
+	if pq.backward {
+		forward, backward = true, more
+	}
+	p := Pager{}
+	if forward {
+		p.Next = template.URL("?" + pq.forwardParam() + "=" + last.String())
+	}
+	if backward {
+		p.Prev = template.URL("?" + pq.backwardParam() + "=" + first.String())
+	}
+	return p
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCursorString(t *testing.T) {
+	tests := []struct {
+		c    Cursor
+		want string
+	}{
+		{Cursor{time.Unix(1443268800, 0), 42}, "1443268800-42"},
+		{Cursor{time.Unix(1443268800, 999999999), 42}, "1443268800-42"},
+		{Cursor{time.Unix(0, 0), 0}, "0-0"},
+		// Search cursors have negated comment IDs.
+		{Cursor{time.Unix(1443268800, 0), -7}, "1443268800--7"},
+	}
+	for _, tt := range tests {
+		if got := tt.c.String(); got != tt.want {
+			t.Errorf("%v.String() = %q, want %q", tt.c, got, tt.want)
+		}
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Cursor
+		ok   bool
+	}{
+		{"1443268800-42", Cursor{time.Unix(1443268800, 0), 42}, true},
+		{"0-0", Cursor{time.Unix(0, 0), 0}, true},
+		{"1443268800--7", Cursor{time.Unix(1443268800, 0), -7}, true},
+		{"", Cursor{}, false},
+		{"1443268800", Cursor{}, false},
+		{"1443268800-", Cursor{}, false},
+		{"-42", Cursor{}, false},
+		{"x-42", Cursor{}, false},
+		{"1443268800-x", Cursor{}, false},
+		{"1443268800-4.2", Cursor{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseCursor(tt.s)
+		if ok != tt.ok || !got.Time.Equal(tt.want.Time) || got.ID != tt.want.ID {
+			t.Errorf("parseCursor(%q) = %v, %v, want %v, %v", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := Cursor{time.Date(2015, 9, 26, 12, 0, 0, 0, time.UTC), 123}
+	got, ok := parseCursor(c.String())
+	if !ok || !got.Time.Equal(c.Time) || got.ID != c.ID {
+		t.Errorf("parseCursor(%q) = %v, %v, want %v", c.String(), got, ok, c)
+	}
+}
+
+func TestCursorBefore(t *testing.T) {
+	t0 := time.Unix(1443268800, 0)
+	tests := []struct {
+		a, b Cursor
+		want bool
+	}{
+		{Cursor{t0, 1}, Cursor{t0.Add(time.Second), 0}, true},
+		{Cursor{t0.Add(time.Second), 0}, Cursor{t0, 1}, false},
+		{Cursor{t0, 1}, Cursor{t0, 2}, true},
+		{Cursor{t0, 2}, Cursor{t0, 1}, false},
+		{Cursor{t0, 1}, Cursor{t0, 1}, false},
+		{Cursor{t0, -2}, Cursor{t0, -1}, true},
+		// The same instant in another location is equal.
+		{Cursor{t0.In(time.FixedZone("JST", 9*3600)), 1}, Cursor{t0, 2}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.a.before(tt.b); got != tt.want {
+			t.Errorf("%v.before(%v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
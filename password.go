@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Stored format: pbkdf2-sha512$<iterations>$<salt hex>$<key hex>
+// Users created by the original app have a bare hex SHA-512 of passwd+salt
+// with the salt in the salts table; those are upgraded on the next login.
+const passhashScheme = "pbkdf2-sha512"
+
+var passwordIterations = 10000
+
+const (
+	passwordSaltLen = 16
+	passwordKeyLen  = 32
+)
+
+func deriveKey(passwd, salt []byte, iter, keyLen int) []byte {
+	return pbkdf2.Key(passwd, salt, iter, keyLen, sha512.New)
+}
+
+func hashPassword(passwd string) string {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	key := deriveKey([]byte(passwd), salt, passwordIterations, passwordKeyLen)
+	return passhashScheme + "$" + strconv.Itoa(passwordIterations) + "$" + hex.EncodeToString(salt) + "$" + hex.EncodeToString(key)
+}
+
+func legacyPasshash(passwd, salt string) string {
+	sum := sha512.Sum512([]byte(passwd + salt))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyPassword reports whether passwd matches u, and whether the stored hash
+// should be replaced because it uses the legacy scheme or an outdated cost.
+func verifyPassword(u *User, passwd string) (ok, rehash bool) {
+	parts := strings.Split(u.passhash, "$")
+	if len(parts) != 4 || parts[0] != passhashScheme {
+		// Spend as long as on a current hash, so that the response time
+		// doesn't tell legacy accounts from the rest.
+		deriveKey([]byte(passwd), []byte(u.salt), passwordIterations, passwordKeyLen)
+		h := legacyPasshash(passwd, u.salt)
+		ok = subtle.ConstantTimeCompare([]byte(h), []byte(strings.ToLower(u.passhash))) == 1
+		return ok, ok
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false, false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false, false
+	}
+	want, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false, false
+	}
+	got := deriveKey([]byte(passwd), salt, iter, len(want))
+	ok = subtle.ConstantTimeCompare(got, want) == 1
+	return ok, ok && iter != passwordIterations
+}
+
+// dummyPasshash is verified against when the email is unknown, so that the
+// response time doesn't reveal which addresses are registered. It is set
+// once passwordIterations is configured.
+var dummyPasshash string
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	tests := []struct {
+		iter int
+		want string
+	}{
+		{1, "867f70cf1ade02cff3752599a3a53dc4af34c7a669815ae5d513554e1c8cf252c02d470a285a0501bad999bfe943c08f050235d7d68b1da55e63f73b60a57fce"},
+		{2, "e1d9c16aa681708a45f5c7c4e215ceb66e011a2e9f0040713f18aefdb866d53cf76cab2868a39b9f7840edce4fef5a82be67335c77a6068e04112754f27ccf4e"},
+	}
+	for _, tt := range tests {
+		got := hex.EncodeToString(deriveKey([]byte("password"), []byte("salt"), tt.iter, 64))
+		if got != tt.want {
+			t.Errorf("deriveKey with %d iterations = %s, want %s", tt.iter, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyPassword(t *testing.T) {
+	// A hash made at an older cost: 1000 iterations over the salt 00..0f.
+	outdated := passhashScheme + "$1000$000102030405060708090a0b0c0d0e0f$f25b652dee5c23a28dad63a63059138b6884edf11724a24947d9618ddff14a7e"
+	// SHA-512 of "secret"+"salt123", as stored by the original app.
+	legacy := "40a9379dd869f62a0349263b29a8c94fa7426f0303b0c7513b833e224fb7b57bf1009df46041d89794c6d8cc68a8627f52749c5a180fed639551edfc3f781030"
+	current := hashPassword("secret")
+
+	tests := []struct {
+		name       string
+		user       User
+		passwd     string
+		ok, rehash bool
+	}{
+		{"current", User{passhash: current}, "secret", true, false},
+		{"current, wrong password", User{passhash: current}, "Secret", false, false},
+		{"outdated cost", User{passhash: outdated}, "secret", true, true},
+		{"outdated cost, wrong password", User{passhash: outdated}, "secret2", false, false},
+		{"legacy", User{passhash: legacy, salt: "salt123"}, "secret", true, true},
+		{"legacy in upper case", User{passhash: strings.ToUpper(legacy), salt: "salt123"}, "secret", true, true},
+		{"legacy, wrong password", User{passhash: legacy, salt: "salt123"}, "secret ", false, false},
+		{"legacy, wrong salt", User{passhash: legacy, salt: "salt124"}, "secret", false, false},
+		{"dummy", User{passhash: hashPassword("")}, "secret", false, false},
+		{"bad iterations", User{passhash: passhashScheme + "$0$00$00"}, "secret", false, false},
+		{"bad salt", User{passhash: passhashScheme + "$1000$zz$00"}, "secret", false, false},
+		{"bad key", User{passhash: passhashScheme + "$1000$00$zz"}, "secret", false, false},
+		{"empty", User{}, "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, rehash := verifyPassword(&tt.user, tt.passwd)
+			if ok != tt.ok || rehash != tt.rehash {
+				t.Errorf("verifyPassword = %v, %v, want %v, %v", ok, rehash, tt.ok, tt.rehash)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	a, b := hashPassword("secret"), hashPassword("secret")
+	if a == b {
+		t.Error("two hashes of the same password are equal; the salt isn't random")
+	}
+	parts := strings.Split(a, "$")
+	if len(parts) != 4 || parts[0] != passhashScheme || parts[1] != strconv.Itoa(passwordIterations) {
+		t.Fatalf("hashPassword = %q, want %s$%d$<salt>$<key>", a, passhashScheme, passwordIterations)
+	}
+	if len(parts[2]) != 2*passwordSaltLen || len(parts[3]) != 2*passwordKeyLen {
+		t.Errorf("hashPassword = %q: salt or key has the wrong length", a)
+	}
+}
@@ -8,4 +8,139 @@ CREATE TABLE `entries2` (
         PRIMARY KEY (`id`),
         KEY `user_id` (`user_id`,`created_at`),
         KEY `created_at` (`created_at`)
-) ENGINE=InnoDB ROW_FORMAT=COMPRESSED DEFAULT CHARSET=utf8mb4
+) ENGINE=InnoDB ROW_FORMAT=COMPRESSED DEFAULT CHARSET=utf8mb4;
+
+-- users.passhash holds "pbkdf2-sha512$<iter>$<salt>$<key>" for upgraded users.
+ALTER TABLE `users` MODIFY `passhash` varchar(255) NOT NULL;
+
+CREATE TABLE `friend_requests` (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `from_user_id` int(11) NOT NULL,
+        `to_user_id` int(11) NOT NULL,
+        `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (`id`),
+        UNIQUE KEY `from_to` (`from_user_id`,`to_user_id`),
+        KEY `to_user_id` (`to_user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `blocks` (
+        `user_id` int(11) NOT NULL,
+        `blocked_user_id` int(11) NOT NULL,
+        `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (`user_id`,`blocked_user_id`),
+        KEY `blocked_user_id` (`blocked_user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `entry_revisions` (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `entry_id` int(11) NOT NULL,
+        `private` tinyint(4) NOT NULL,
+        `title` varchar(128),
+        `body` text,
+        `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (`id`),
+        KEY `entry_id` (`entry_id`,`id`)
+) ENGINE=InnoDB ROW_FORMAT=COMPRESSED DEFAULT CHARSET=utf8mb4;
+
+-- Keyset pagination indexes; InnoDB appends the primary key, so these also
+-- cover the (created_at, id) tie-break.
+ALTER TABLE `comments` ADD KEY `entry_id_created_at` (`entry_id`,`created_at`);
+ALTER TABLE `relations` ADD KEY `one_created_at` (`one`,`created_at`);
+ALTER TABLE `footprints` ADD KEY `user_id_created_at` (`user_id`,`created_at`);
+
+-- Only the SHA-256 of each API token is stored.
+CREATE TABLE `api_tokens` (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `user_id` int(11) NOT NULL,
+        `token_hash` char(64) NOT NULL,
+        `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (`id`),
+        UNIQUE KEY `token_hash` (`token_hash`),
+        KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Tokens become named personal access tokens. scopes is space separated;
+-- tokens issued before scopes existed keep full access.
+ALTER TABLE api_tokens ADD `name` varchar(64) NOT NULL DEFAULT '', ADD `scopes` varchar(255) NOT NULL DEFAULT '', ADD `last_used_at` timestamp NULL DEFAULT NULL;
+UPDATE api_tokens SET scopes = 'entries:read entries:write footprints:read friends' WHERE scopes = '';
+
+-- Failed logins, for auditing and so that login throttling survives
+-- restarts. cleared is set once the email logs in successfully.
+CREATE TABLE `login_failures` (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `email` varchar(255) NOT NULL,
+        `ip` varchar(64) NOT NULL,
+        `user_id` int(11) DEFAULT NULL,
+        `cleared` tinyint(1) NOT NULL DEFAULT 0,
+        `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (`id`),
+        KEY `created_at` (`created_at`),
+        KEY `email` (`email`, `cleared`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Server-side sessions. The cookie carries the session ID; only its SHA-256
+-- is stored. data is the gob-encoded session values.
+CREATE TABLE `sessions` (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `token_hash` char(64) NOT NULL,
+        `user_id` int(11) NOT NULL DEFAULT 0,
+        `data` blob NOT NULL,
+        `user_agent` varchar(255) NOT NULL DEFAULT '',
+        `ip` varchar(64) NOT NULL DEFAULT '',
+        `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        `last_seen_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (`id`),
+        UNIQUE KEY `token_hash` (`token_hash`),
+        KEY `user_id` (`user_id`),
+        KEY `last_seen_at` (`last_seen_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- entries2.private now holds the entry's audience: 0 public, 1 friends,
+-- 2 friends of friends, 3 the friend list list_id, 4 only the owner.
+ALTER TABLE `entries2` ADD `list_id` int(11) NOT NULL DEFAULT 0 AFTER `private`;
+ALTER TABLE `entry_revisions` ADD `list_id` int(11) NOT NULL DEFAULT 0 AFTER `private`;
+
+CREATE TABLE `friend_lists` (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `user_id` int(11) NOT NULL,
+        `name` varchar(64) NOT NULL,
+        `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (`id`),
+        KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `friend_list_members` (
+        `list_id` int(11) NOT NULL,
+        `user_id` int(11) NOT NULL,
+        PRIMARY KEY (`list_id`, `user_id`),
+        KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Who may comment on an entry: 0 anyone who can read it, 1 friends, 2 nobody.
+ALTER TABLE `entries2` ADD `comment_policy` tinyint NOT NULL DEFAULT 0 AFTER `list_id`;
+
+-- Threaded comments. root_id is the top-level comment of the thread (0 for
+-- top-level comments themselves) and depth its nesting, for fetching and
+-- rendering a page of threads without walking parent_id.
+ALTER TABLE `comments` ADD `parent_id` int(11) NOT NULL DEFAULT 0, ADD `root_id` int(11) NOT NULL DEFAULT 0, ADD `depth` tinyint NOT NULL DEFAULT 0,
+        ADD KEY `entry_id_parent_id_created_at` (`entry_id`, `parent_id`, `created_at`), ADD KEY `root_id` (`root_id`);
+
+CREATE TABLE `notifications` (
+        `id` int(11) NOT NULL AUTO_INCREMENT,
+        `user_id` int(11) NOT NULL,
+        `kind` varchar(32) NOT NULL,
+        `actor_id` int(11) NOT NULL,
+        `entry_id` int(11) NOT NULL DEFAULT 0,
+        `comment_id` int(11) NOT NULL DEFAULT 0,
+        `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (`id`),
+        KEY `user_id_created_at` (`user_id`, `created_at`),
+        KEY `entry_id` (`entry_id`),
+        KEY `comment_id` (`comment_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Notifications are unread until read_at is set.
+ALTER TABLE `notifications` ADD `read_at` timestamp NULL DEFAULT NULL, ADD KEY `user_id_read_at` (`user_id`, `read_at`);
+
+-- Deactivated accounts are hidden until their owner logs in again.
+ALTER TABLE `users` ADD `deactivated_at` timestamp NULL DEFAULT NULL;
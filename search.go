@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Search looks up entries and comments in an in-memory inverted index from
+// character bigrams to documents, which works for Japanese text without a
+// dictionary. Bigrams only narrow down the candidates; each one is read back
+// from the DB and checked to contain every search term.
+//
+// Each posting list is sorted by (created_at, id), so a page of results is
+// found by walking the shortest list from the newest end and stopping once
+// the page is full.
+
+// searchDoc is an indexed entry or comment. Entries are keyed by their ID and
+// comments by their negated ID, so that both fit in one index.
+type searchDoc struct {
+	entryID   int
+	userID    int // the author
+	createdAt time.Time
+	// Set for entries. A comment is visible when its entry is.
+	audience Audience
+	listID   int
+}
+
+func entryDocID(id int) int   { return id }
+func commentDocID(id int) int { return -id }
+
+type SearchIndex struct {
+	sync.RWMutex
+	docs map[int]*searchDoc
+	// Postings are not removed with their documents; lookups skip IDs that
+	// are no longer in docs.
+	postings map[string][]Cursor
+	built    bool
+}
+
+var searchIndex = SearchIndex{docs: make(map[int]*searchDoc), postings: make(map[string][]Cursor)}
+
+// normalizeText lowercases s rune by rune, so that it has as many runes as s.
+func normalizeText(s string) string {
+	return strings.Map(unicode.ToLower, s)
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// bigrams returns the distinct pairs of adjacent letters or digits in s.
+func bigrams(s string) []string {
+	seen := make(map[string]bool)
+	var grams []string
+	for _, word := range strings.FieldsFunc(normalizeText(s), func(r rune) bool { return !isWordRune(r) }) {
+		rs := []rune(word)
+		for i := 0; i+1 < len(rs); i++ {
+			g := string(rs[i : i+2])
+			if !seen[g] {
+				seen[g] = true
+				grams = append(grams, g)
+			}
+		}
+	}
+	return grams
+}
+
+// searchPosition finds c in the posting list p: the index where it is or
+// would be inserted.
+func searchPosition(p []Cursor, c Cursor) int {
+	return sort.Search(len(p), func(i int) bool { return !p[i].before(c) })
+}
+
+func hasPosting(p []Cursor, c Cursor) bool {
+	i := searchPosition(p, c)
+	return i < len(p) && p[i].ID == c.ID
+}
+
+// add indexes the document id. New documents are usually the newest, so
+// they are appended to the postings without a search.
+func (si *SearchIndex) add(id int, d *searchDoc, text string) {
+	si.docs[id] = d
+	c := Cursor{d.createdAt, id}
+	for _, g := range bigrams(text) {
+		p := si.postings[g]
+		if n := len(p); n == 0 || p[n-1].before(c) {
+			si.postings[g] = append(p, c)
+			continue
+		}
+		i := searchPosition(p, c)
+		if i < len(p) && p[i].ID == id {
+			continue
+		}
+		p = append(p, Cursor{})
+		copy(p[i+1:], p[i:])
+		p[i] = c
+		si.postings[g] = p
+	}
+}
+
+func (si *SearchIndex) removePostings(id int, createdAt time.Time, text string) {
+	c := Cursor{createdAt, id}
+	for _, g := range bigrams(text) {
+		p := si.postings[g]
+		if i := searchPosition(p, c); i < len(p) && p[i].ID == id {
+			si.postings[g] = append(p[:i], p[i+1:]...)
+		}
+	}
+}
+
+// Init builds the index from every entry and comment the first time it
+// runs, at startup. Reading them all takes long, so when /initialize runs
+// it again the index is kept, and GetInitialize calls Truncate instead.
+func (si *SearchIndex) Init(ctx context.Context) {
+	si.RLock()
+	built := si.built
+	si.RUnlock()
+	if built {
+		return
+	}
+
+	docs := make(map[int]*searchDoc, 1<<16)
+	postings := make(map[string][]Cursor, 1<<16)
+	build := func(id int, d *searchDoc, text string) {
+		docs[id] = d
+		for _, g := range bigrams(text) {
+			postings[g] = append(postings[g], Cursor{d.createdAt, id})
+		}
+	}
+
+	rows, err := dbQuery(ctx, db, "search.init_entries", `SELECT id, user_id, private, list_id, title, body, created_at FROM entries2`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	for rows.Next() {
+		var id int
+		var title, body string
+		d := &searchDoc{}
+		checkErr(rows.Scan(&id, &d.userID, &d.audience, &d.listID, &title, &body, &d.createdAt))
+		d.entryID = id
+		build(entryDocID(id), d, title+"\n"+body)
+	}
+	rows.Close()
+
+	rows, err = dbQuery(ctx, db, "search.init_comments", `SELECT id, entry_id, user_id, comment, created_at FROM comments`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	for rows.Next() {
+		var id int
+		var comment string
+		d := &searchDoc{}
+		checkErr(rows.Scan(&id, &d.entryID, &d.userID, &comment, &d.createdAt))
+		build(commentDocID(id), d, comment)
+	}
+	rows.Close()
+	for _, p := range postings {
+		sort.Slice(p, func(i, j int) bool { return p[i].before(p[j]) })
+	}
+
+	si.Lock()
+	si.docs, si.postings, si.built = docs, postings, true
+	si.Unlock()
+}
+
+func (si *SearchIndex) Len() int {
+	si.RLock()
+	defer si.RUnlock()
+	return len(si.docs)
+}
+
+// Truncate removes the entries and comments with IDs above maxEntryID and
+// maxCommentID, which /initialize deletes. They are the newest, so their
+// postings are trimmed off the ends of the lists.
+func (si *SearchIndex) Truncate(maxEntryID, maxCommentID int) {
+	si.Lock()
+	defer si.Unlock()
+	for id := range si.docs {
+		if id > maxEntryID || -id > maxCommentID {
+			delete(si.docs, id)
+		}
+	}
+	for g, p := range si.postings {
+		n := len(p)
+		for n > 0 && si.docs[p[n-1].ID] == nil {
+			n--
+		}
+		if n == 0 {
+			delete(si.postings, g)
+		} else {
+			si.postings[g] = p[:n]
+		}
+	}
+}
+
+func (si *SearchIndex) AddEntry(e Entry) {
+	si.Lock()
+	defer si.Unlock()
+	si.add(entryDocID(e.ID), &searchDoc{e.ID, e.UserID, e.CreatedAt, e.Audience, e.ListID}, e.Title+"\n"+e.Content)
+}
+
+// UpdateEntry reindexes an edited entry. Unlike deleted documents, the
+// postings of the old text must go, or the entry would stay a candidate
+// for words it no longer contains.
+func (si *SearchIndex) UpdateEntry(old, e Entry) {
+	id := entryDocID(e.ID)
+	si.Lock()
+	defer si.Unlock()
+	si.removePostings(id, old.CreatedAt, old.Title+"\n"+old.Content)
+	si.add(id, &searchDoc{e.ID, e.UserID, e.CreatedAt, e.Audience, e.ListID}, e.Title+"\n"+e.Content)
+}
+
+// RemoveEntry removes an entry, which also hides its comments.
+func (si *SearchIndex) RemoveEntry(entryID int) {
+	si.Lock()
+	delete(si.docs, entryDocID(entryID))
+	si.Unlock()
+}
+
+func (si *SearchIndex) AddComment(c Comment) {
+	si.Lock()
+	defer si.Unlock()
+	// Cursors have whole seconds, like the times read from the DB.
+	d := &searchDoc{entryID: c.EntryID, userID: c.UserID, createdAt: c.CreatedAt.Truncate(time.Second)}
+	si.add(commentDocID(c.ID), d, c.Comment)
+}
+
+func (si *SearchIndex) RemoveComments(commentIDs ...int) {
+	si.Lock()
+	for _, id := range commentIDs {
+		delete(si.docs, commentDocID(id))
+	}
+	si.Unlock()
+}
+
+func (si *SearchIndex) RemoveUser(userID int) {
+	si.Lock()
+	for id, d := range si.docs {
+		if d.userID == userID {
+			delete(si.docs, id)
+		}
+	}
+	si.Unlock()
+}
+
+// visible reports whether viewerID may see the document d. The caller holds
+// the read lock.
+func (si *SearchIndex) visible(viewerID int, d *searchDoc) bool {
+	entry := si.docs[entryDocID(d.entryID)]
+	if entry == nil {
+		return false
+	}
+	if d != entry && blockRepo.Between(viewerID, d.userID) {
+		return false
+	}
+	return canView(viewerID, entry.userID, entry.audience, entry.listID)
+}
+
+// Candidates returns up to n of the documents viewerID may see that contain
+// every bigram of terms, as positions in the index. They are in the order
+// pq walks, starting past its cursor.
+func (si *SearchIndex) Candidates(viewerID int, terms []string, pq pageQuery, n int) []Cursor {
+	var grams []string
+	for _, t := range terms {
+		grams = append(grams, bigrams(t)...)
+	}
+	if len(grams) == 0 {
+		return nil
+	}
+
+	si.RLock()
+	defer si.RUnlock()
+	lists := make([][]Cursor, len(grams))
+	for i, g := range grams {
+		lists[i] = si.postings[g]
+		if len(lists[i]) == 0 {
+			return nil
+		}
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	rarest := lists[0]
+
+	i, step := 0, 1
+	if pq.descending() {
+		i, step = len(rarest)-1, -1
+		if pq.hasCursor {
+			i = searchPosition(rarest, pq.cursor) - 1
+		}
+	} else if pq.hasCursor {
+		i = searchPosition(rarest, pq.cursor)
+		if i < len(rarest) && rarest[i].ID == pq.cursor.ID {
+			i++
+		}
+	}
+	var cands []Cursor
+	for ; i >= 0 && i < len(rarest) && len(cands) < n; i += step {
+		c := rarest[i]
+		d := si.docs[c.ID]
+		if d == nil {
+			continue
+		}
+		found := true
+		for _, p := range lists[1:] {
+			if !hasPosting(p, c) {
+				found = false
+				break
+			}
+		}
+		if found && si.visible(viewerID, d) {
+			cands = append(cands, c)
+		}
+	}
+	return cands
+}
+
+const (
+	searchResultsPerPage = 20
+	maxSearchQueryLen    = 100 // in runes
+	searchSnippetLen     = 100 // in runes
+)
+
+// SearchHit is an entry or comment found by /search.
+type SearchHit struct {
+	EntryID    int
+	CommentID  int // 0 for the entry itself
+	UserID     int
+	EntryTitle string
+	Snippet    string
+	CreatedAt  time.Time
+	cursor     Cursor // the position of the hit in the index
+}
+
+func (h SearchHit) URL() string {
+	if h.CommentID != 0 {
+		return "/diary/entry/" + strconv.Itoa(h.EntryID) + "#comment-" + strconv.Itoa(h.CommentID)
+	}
+	return "/diary/entry/" + strconv.Itoa(h.EntryID)
+}
+
+// searchTerms splits q into the terms that must all appear in a result.
+// Terms of one character can't be looked up by bigram and are dropped.
+func searchTerms(q string) []string {
+	var terms []string
+	for _, t := range strings.FieldsFunc(normalizeText(q), func(r rune) bool { return !isWordRune(r) }) {
+		if utf8.RuneCountInString(t) >= 2 {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// snippet returns about searchSnippetLen runes of text around the first
+// occurrence of term in normalized, its normalizeText.
+func snippet(text, normalized, term string) string {
+	rs := []rune(strings.Replace(text, "\n", " ", -1))
+	pos := 0
+	if i := strings.Index(normalized, term); i >= 0 {
+		pos = utf8.RuneCountInString(normalized[:i])
+	}
+	start := pos - searchSnippetLen/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + searchSnippetLen
+	if end > len(rs) {
+		end = len(rs)
+	}
+	s := string(rs[start:end])
+	if start > 0 {
+		s = "…" + s
+	}
+	if end < len(rs) {
+		s += "…"
+	}
+	return s
+}
+
+func containsAll(normalized string, terms []string) bool {
+	for _, t := range terms {
+		if !strings.Contains(normalized, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadSearchHits reads the candidates back from the DB and returns those
+// that really contain every term, in the order given.
+func loadSearchHits(ctx context.Context, cands []Cursor, terms []string) []SearchHit {
+	var entryIDs, commentIDs []interface{}
+	for _, c := range cands {
+		if c.ID > 0 {
+			entryIDs = append(entryIDs, c.ID)
+		} else {
+			commentIDs = append(commentIDs, -c.ID)
+		}
+	}
+	byDoc := make(map[int]SearchHit, len(cands))
+	if len(entryIDs) > 0 {
+		rows, err := dbQuery(ctx, db, "search.entries", `SELECT id, user_id, title, body, created_at FROM entries2 WHERE id IN (?`+strings.Repeat(",?", len(entryIDs)-1)+`)`, entryIDs...)
+		if err != sql.ErrNoRows {
+			checkErr(err)
+		}
+		for rows.Next() {
+			var h SearchHit
+			var body string
+			checkErr(rows.Scan(&h.EntryID, &h.UserID, &h.EntryTitle, &body, &h.CreatedAt))
+			if containsAll(normalizeText(h.EntryTitle+"\n"+body), terms) {
+				h.Snippet = snippet(body, normalizeText(body), terms[0])
+				byDoc[entryDocID(h.EntryID)] = h
+			}
+		}
+		rows.Close()
+	}
+	if len(commentIDs) > 0 {
+		rows, err := dbQuery(ctx, db, "search.comments", `SELECT c.id, c.entry_id, c.user_id, c.comment, c.created_at, e.title FROM comments c JOIN entries2 e ON e.id = c.entry_id WHERE c.id IN (?`+strings.Repeat(",?", len(commentIDs)-1)+`)`, commentIDs...)
+		if err != sql.ErrNoRows {
+			checkErr(err)
+		}
+		for rows.Next() {
+			var h SearchHit
+			var comment string
+			checkErr(rows.Scan(&h.CommentID, &h.EntryID, &h.UserID, &comment, &h.CreatedAt, &h.EntryTitle))
+			if n := normalizeText(comment); containsAll(n, terms) {
+				h.Snippet = snippet(comment, n, terms[0])
+				byDoc[commentDocID(h.CommentID)] = h
+			}
+		}
+		rows.Close()
+	}
+	hits := make([]SearchHit, 0, len(byDoc))
+	for _, c := range cands {
+		if h, ok := byDoc[c.ID]; ok {
+			h.cursor = c
+			hits = append(hits, h)
+		}
+	}
+	return hits
+}
+
+// search returns the page pq describes of what viewerID finds with terms,
+// newest first.
+func search(ctx context.Context, viewerID int, terms []string, pq pageQuery) ([]SearchHit, Pager) {
+	// Read one more hit than fits on the page, to know whether there is
+	// another page. Candidates are read in batches, since some turn out
+	// not to contain the terms.
+	hits := make([]SearchHit, 0, pq.limit+1)
+	walk := pq
+	for len(hits) <= pq.limit {
+		cands := searchIndex.Candidates(viewerID, terms, walk, pq.limit)
+		hits = append(hits, loadSearchHits(ctx, cands, terms)...)
+		if len(cands) < pq.limit {
+			break
+		}
+		walk.cursor, walk.hasCursor = cands[len(cands)-1], true
+	}
+	fetched := len(hits)
+	hits = hits[:pq.keep(fetched)]
+	if pq.backward {
+		for i := 0; i < len(hits)/2; i++ {
+			hits[i], hits[len(hits)-1-i] = hits[len(hits)-1-i], hits[i]
+		}
+	}
+	var pager Pager
+	if len(hits) > 0 {
+		pager = pq.pager(fetched, hits[0].cursor, hits[len(hits)-1].cursor)
+	}
+	return hits, pager
+}
+
+// withQuery adds the search query to a link from Pager.
+func withQuery(u template.URL, q string) template.URL {
+	if u == "" {
+		return u
+	}
+	return template.URL("?q=" + url.QueryEscape(q) + "&" + strings.TrimPrefix(string(u), "?"))
+}
+
+func GetSearch(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	q := strings.TrimSpace(r.FormValue("q"))
+	var (
+		hits    []SearchHit
+		pager   Pager
+		message string
+	)
+	switch terms := searchTerms(q); {
+	case q == "":
+	case utf8.RuneCountInString(q) > maxSearchQueryLen:
+		message = "検索する言葉が長すぎます"
+	case len(terms) == 0:
+		message = "2文字以上の言葉で検索してください"
+	default:
+		hits, pager = search(r.Context(), user.ID, terms, newPageQuery(r, searchResultsPerPage, true))
+		pager.Prev, pager.Next = withQuery(pager.Prev, q), withQuery(pager.Next, q)
+		if len(hits) == 0 {
+			message = "見つかりませんでした"
+		}
+	}
+	render(w, r, http.StatusOK, "search.html", &struct {
+		Page
+		Query   string
+		Hits    []SearchHit
+		Pager   Pager
+		Message string
+	}{Page{}, q, hits, pager, message})
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeText(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"Go言語", "go言語"},
+		{"ＧＯ言語", "ｇｏ言語"},
+		{"ISUCON 5", "isucon 5"},
+		{"İstanbul", "istanbul"},
+	}
+	for _, tt := range tests {
+		got := normalizeText(tt.s)
+		if got != tt.want {
+			t.Errorf("normalizeText(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+		// snippet counts runes in the normalized text to cut the original.
+		if utf8.RuneCountInString(got) != utf8.RuneCountInString(tt.s) {
+			t.Errorf("normalizeText(%q) = %q changes the rune count", tt.s, got)
+		}
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	tests := []struct {
+		q    string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"a", nil},
+		{"言", nil},
+		{"Go言語 入門", []string{"go言語", "入門"}},
+		{"ISUCON、予選。", []string{"isucon", "予選"}},
+		{"foo-bar/baz", []string{"foo", "bar", "baz"}},
+		{"a bc 1 23", []string{"bc", "23"}},
+		{"！？", nil},
+	}
+	for _, tt := range tests {
+		if got := searchTerms(tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("searchTerms(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestBigrams(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"a", nil},
+		{"Go言語", []string{"go", "o言", "言語"}},
+		{"go go", []string{"go"}},
+		{"ab, cd", []string{"ab", "cd"}},
+		{"ああああ", []string{"ああ"}},
+	}
+	for _, tt := range tests {
+		if got := bigrams(tt.s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("bigrams(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
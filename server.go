@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// inheritEnv lists, in order, the names of the listeners passed as fd 3, 4, ...
+// by a parent process handing over its sockets (see handoff).
+const inheritEnv = "ISUXI_INHERITED_LISTENERS"
+
+var inherited bool
+
+type namedListener struct {
+	name string
+	net.Listener
+}
+
+// openListeners returns the debug, http and unix listeners that are
+// configured, reusing the ones inherited from a parent process if any.
+func openListeners() ([]namedListener, error) {
+	fds := map[string]net.Listener{}
+	if names := os.Getenv(inheritEnv); names != "" {
+		for i, name := range strings.Split(names, ",") {
+			f := os.NewFile(uintptr(3+i), name)
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("inherited listener %s: %v", name, err)
+			}
+			fds[name] = l
+		}
+		os.Unsetenv(inheritEnv)
+		inherited = true
+	}
+
+	var ls []namedListener
+	open := func(name, network, addr string) error {
+		if addr == "" {
+			return nil
+		}
+		if l, ok := fds[name]; ok {
+			ls = append(ls, namedListener{name, l})
+			return nil
+		}
+		if network == "unix" {
+			os.Remove(addr)
+		}
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return err
+		}
+		if ul, ok := l.(*net.UnixListener); ok {
+			// Leave the socket file in place on shutdown, since it may
+			// have been handed over to a new process.
+			ul.SetUnlinkOnClose(false)
+			os.Chmod(addr, os.FileMode(config.UnixSocketMode))
+		}
+		ls = append(ls, namedListener{name, l})
+		return nil
+	}
+	if err := open("debug", "tcp", config.DebugAddr); err != nil {
+		return nil, err
+	}
+	if err := open("http", "tcp", config.HTTPAddr); err != nil {
+		return nil, err
+	}
+	if err := open("unix", "unix", config.UnixSocket); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// splitListeners separates the listeners with the given names from the rest.
+func splitListeners(ls []namedListener, names ...string) (matched, rest []namedListener) {
+	for _, l := range ls {
+		found := false
+		for _, n := range names {
+			found = found || l.name == n
+		}
+		if found {
+			matched = append(matched, l)
+		} else {
+			rest = append(rest, l)
+		}
+	}
+	return matched, rest
+}
+
+// serve starts one server per listener. The debug listener serves
+// http.DefaultServeMux (pprof and the like), the others serve h.
+func serve(ls []namedListener, h http.Handler) []*http.Server {
+	servers := make([]*http.Server, 0, len(ls))
+	for _, l := range ls {
+		srv := &http.Server{Handler: h}
+		if l.name == "debug" {
+			srv.Handler = nil
+		}
+		servers = append(servers, srv)
+		go func(l namedListener) {
+			if err := srv.Serve(l); err != http.ErrServerClosed {
+				fatal("listener failed", "listener", l.name, "err", err)
+			}
+		}(l)
+	}
+	return servers
+}
+
+// handoff starts a new process, by default the same binary, passing it the
+// listening sockets. Once the new process is ready it sends us SIGTERM.
+func handoff(ls []namedListener) error {
+	bin := config.UpgradeBinary
+	if bin == "" {
+		var err error
+		if bin, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(ls))
+	files := make([]*os.File, 0, len(ls))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range ls {
+		fl, ok := l.Listener.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return fmt.Errorf("%s listener can't be handed over", l.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(bin, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), inheritEnv+"="+strings.Join(names, ","))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	slog.Info("started new process", "binary", bin, "pid", cmd.Process.Pid, "listeners", strings.Join(names, ","))
+	return nil
+}
+
+// notifyParent tells the process we inherited our listeners from that it can
+// stop accepting connections.
+func notifyParent() {
+	if inherited {
+		syscall.Kill(os.Getppid(), syscall.SIGTERM)
+	}
+}
+
+// asyncWrites tracks background DB writes that must finish before exit.
+var asyncWrites sync.WaitGroup
+
+func goAsync(f func()) {
+	asyncWrites.Add(1)
+	go func() {
+		defer asyncWrites.Done()
+		f()
+	}()
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT, handing the listeners over
+// to a new process on SIGUSR2. It then stops accepting connections, waits
+// up to ShutdownTimeout for in-flight requests and pending async writes.
+func waitForShutdown(ls []namedListener, servers []*http.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT, syscall.SIGUSR2)
+	for sig := range ch {
+		if sig != syscall.SIGUSR2 {
+			slog.Info("shutting down", "signal", sig.String())
+			break
+		}
+		if err := handoff(ls); err != nil {
+			slog.Error("handoff failed", "err", err)
+		}
+	}
+	signal.Stop(ch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("shutdown", "err", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		asyncWrites.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		slog.Warn("shutdown: gave up waiting for async writes")
+	}
+}
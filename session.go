@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// Sessions are kept in the sessions table, with the live ones cached in
+// memory. The cookie only carries a random session ID, signed with the
+// session secret; the table stores its SHA-256, like api_tokens. Deleting a
+// row logs that session out.
+//
+// Sessions without a user only hold the CSRF token and have nothing to list
+// or revoke, so they aren't stored: the signed cookie carries their values
+// instead, after anonSessionPrefix.
+
+const (
+	sessionName = "isucon5q-go.session"
+
+	// sessionTouchInterval limits how often last_seen_at is written for a
+	// session in constant use.
+	sessionTouchInterval = time.Minute
+
+	// sessionCheckInterval is how long a cached session is trusted before
+	// lookup reads it again, so that revoking it in another process, such
+	// as the other one during a handover, takes effect here too.
+	sessionCheckInterval = 5 * time.Second
+
+	anonSessionPrefix = "anon-"
+
+	// maxMissingSessions bounds the cache of session IDs known not to be in
+	// the table, such as those of revoked sessions still sent by browsers.
+	maxMissingSessions = 10000
+)
+
+// LoginSession is a row of the sessions table.
+type LoginSession struct {
+	ID         int
+	Hash       string
+	UserID     int
+	UserAgent  string
+	IP         string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+
+	data      []byte // gob-encoded values, as stored
+	values    map[interface{}]interface{}
+	checkedAt time.Time // when the row was last read
+}
+
+// SessionStore is a sessions.Store backed by the sessions table.
+type SessionStore struct {
+	sync.Mutex
+	secret  []byte
+	Options *sessions.Options
+	byHash  map[string]*LoginSession
+	missing map[string]struct{}
+}
+
+var sessionStore = SessionStore{
+	Options: &sessions.Options{Path: "/", MaxAge: 86400 * 30, HttpOnly: true},
+	byHash:  make(map[string]*LoginSession, 1024),
+	missing: make(map[string]struct{}),
+}
+
+func (ss *SessionStore) maxAge() time.Duration {
+	return time.Duration(ss.Options.MaxAge) * time.Second
+}
+
+// Init drops expired sessions, and any without a user left from before
+// those were kept in the cookie, and caches the rest.
+func (ss *SessionStore) Init(ctx context.Context) {
+	from := time.Now().Add(-ss.maxAge())
+	_, err := dbExec(ctx, db, "sessions.expire", `DELETE FROM sessions WHERE last_seen_at < ? OR user_id = 0`, from)
+	checkErr(err)
+	rows, err := dbQuery(ctx, db, "sessions.init", `SELECT id, token_hash, user_id, data, user_agent, ip, created_at, last_seen_at FROM sessions`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	defer rows.Close()
+	byHash := make(map[string]*LoginSession, 1024)
+	for rows.Next() {
+		s, err := scanLoginSession(rows)
+		checkErr(err)
+		byHash[s.Hash] = s
+	}
+	ss.Lock()
+	ss.byHash = byHash
+	ss.missing = make(map[string]struct{})
+	ss.Unlock()
+}
+
+func scanLoginSession(row interface{ Scan(...interface{}) error }) (*LoginSession, error) {
+	s := &LoginSession{}
+	if err := row.Scan(&s.ID, &s.Hash, &s.UserID, &s.data, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+		return nil, err
+	}
+	s.checkedAt = time.Now()
+	values, err := decodeSessionValues(s.data)
+	if err != nil {
+		return nil, err
+	}
+	s.values = values
+	return s, nil
+}
+
+func decodeSessionValues(data []byte) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	if len(data) > 0 {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&values); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (ss *SessionStore) Len() int {
+	ss.Lock()
+	defer ss.Unlock()
+	return len(ss.byHash)
+}
+
+// lookup returns a copy of the live session with hash, from the cache or
+// else the DB, since another process may have created it. Cached sessions
+// are read again after sessionCheckInterval, in case another process has
+// revoked them. Hashes not found in the DB are remembered, so that stale
+// cookies don't query it on every request.
+func (ss *SessionStore) lookup(ctx context.Context, hash string) *LoginSession {
+	ss.Lock()
+	c, ok := ss.byHash[hash]
+	_, missing := ss.missing[hash]
+	var s LoginSession
+	if ok {
+		s = *c
+	}
+	ss.Unlock()
+	if missing {
+		return nil
+	}
+	if !ok || time.Since(s.checkedAt) > sessionCheckInterval {
+		// Until the repos are loaded, the DB may not even be connected.
+		if !isReady() {
+			return nil
+		}
+		c, err := scanLoginSession(dbQueryRow(ctx, db, "sessions.get", `SELECT id, token_hash, user_id, data, user_agent, ip, created_at, last_seen_at FROM sessions WHERE token_hash = ?`, hash))
+		if err == sql.ErrNoRows {
+			ss.Lock()
+			delete(ss.byHash, hash)
+			if len(ss.missing) >= maxMissingSessions {
+				ss.missing = make(map[string]struct{})
+			}
+			ss.missing[hash] = struct{}{}
+			ss.Unlock()
+			return nil
+		}
+		checkErr(err)
+		// Keep the last use that hasn't been written yet.
+		if ok && s.LastSeenAt.After(c.LastSeenAt) {
+			c.LastSeenAt, c.IP = s.LastSeenAt, s.IP
+		}
+		ss.Lock()
+		ss.byHash[hash] = c
+		ss.Unlock()
+		s = *c
+	}
+	if time.Since(s.LastSeenAt) > ss.maxAge() {
+		return nil
+	}
+	return &s
+}
+
+func (ss *SessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	st := reqState(r)
+	if st.session != nil {
+		return st.session, nil
+	}
+	session, err := ss.New(r, name)
+	st.session = session
+	return session, err
+}
+
+func (ss *SessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(ss, name)
+	opts := *ss.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	id, ok := ss.verify(name, c.Value)
+	if !ok {
+		return session, nil
+	}
+	if strings.HasPrefix(id, anonSessionPrefix) {
+		data, err := base64.RawURLEncoding.DecodeString(id[len(anonSessionPrefix):])
+		if err != nil {
+			return session, nil
+		}
+		values, err := decodeSessionValues(data)
+		if err != nil {
+			return session, nil
+		}
+		session.Values = values
+		session.IsNew = false
+		return session, nil
+	}
+	s := ss.lookup(r.Context(), hashSessionID(id))
+	if s == nil {
+		return session, nil
+	}
+	for k, v := range s.values {
+		session.Values[k] = v
+	}
+	session.ID = id
+	session.IsNew = false
+	ss.touch(s.Hash, clientIP(r))
+	return session, nil
+}
+
+// touch records that the session with hash was used now from ip, writing it
+// to the DB at most every sessionTouchInterval.
+func (ss *SessionStore) touch(hash, ip string) {
+	now := time.Now().Truncate(time.Second)
+	ss.Lock()
+	s, ok := ss.byHash[hash]
+	if !ok || now.Sub(s.LastSeenAt) < sessionTouchInterval && s.IP == ip {
+		ss.Unlock()
+		return
+	}
+	s.LastSeenAt = now
+	s.IP = ip
+	id := s.ID
+	ss.Unlock()
+	goAsync(func() {
+		dbExec(context.Background(), db, "sessions.touch", `UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?`, now, ip, id)
+	})
+}
+
+// Save writes the session and sets its cookie. The session ID changes
+// whenever the logged-in user does, so that an ID planted before login
+// can't be used after it. Sessions without a user go in the cookie only.
+func (ss *SessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	ctx := r.Context()
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := ss.remove(ctx, hashSessionID(session.ID)); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, ss.cookie(session, ""))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(session.Values); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	userID, _ := session.Values["user_id"].(int)
+	if userID == 0 {
+		if session.ID != "" {
+			if err := ss.remove(ctx, hashSessionID(session.ID)); err != nil {
+				return err
+			}
+			session.ID = ""
+		}
+		http.SetCookie(w, ss.cookie(session, ss.sign(session.Name(), anonSessionPrefix+base64.RawURLEncoding.EncodeToString(data))))
+		return nil
+	}
+
+	var s *LoginSession
+	if session.ID != "" {
+		s = ss.lookup(ctx, hashSessionID(session.ID))
+	}
+	if s != nil && s.UserID != userID {
+		if err := ss.remove(ctx, s.Hash); err != nil {
+			return err
+		}
+		s = nil
+	}
+	if s == nil {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		now := time.Now().Truncate(time.Second)
+		s = &LoginSession{Hash: hashSessionID(id), UserID: userID, UserAgent: r.UserAgent(), IP: clientIP(r), CreatedAt: now, LastSeenAt: now, data: data, checkedAt: now}
+		if len(s.UserAgent) > 255 {
+			s.UserAgent = s.UserAgent[:255]
+		}
+		result, err := dbExec(ctx, db, "sessions.insert", `INSERT INTO sessions (token_hash, user_id, data, user_agent, ip, created_at, last_seen_at) VALUES (?,?,?,?,?,?,?)`,
+			s.Hash, s.UserID, s.data, s.UserAgent, s.IP, s.CreatedAt, s.LastSeenAt)
+		if err != nil {
+			return err
+		}
+		n, _ := result.LastInsertId()
+		s.ID = int(n)
+		session.ID = id
+	} else if !bytes.Equal(s.data, data) {
+		if _, err := dbExec(ctx, db, "sessions.update", `UPDATE sessions SET data = ? WHERE id = ?`, data, s.ID); err != nil {
+			return err
+		}
+	}
+	// s is a copy, so it can be stored as is. Its values are never modified
+	// once cached, only replaced.
+	s.data = data
+	s.values = make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		s.values[k] = v
+	}
+	ss.Lock()
+	ss.byHash[s.Hash] = s
+	ss.Unlock()
+	http.SetCookie(w, ss.cookie(session, ss.sign(session.Name(), session.ID)))
+	return nil
+}
+
+func (ss *SessionStore) remove(ctx context.Context, hash string) error {
+	if _, err := dbExec(ctx, db, "sessions.delete", `DELETE FROM sessions WHERE token_hash = ?`, hash); err != nil {
+		return err
+	}
+	ss.Lock()
+	delete(ss.byHash, hash)
+	ss.Unlock()
+	return nil
+}
+
+func (ss *SessionStore) cookie(session *sessions.Session, value string) *http.Cookie {
+	o := session.Options
+	c := &http.Cookie{Name: session.Name(), Value: value, Path: o.Path, Domain: o.Domain, MaxAge: o.MaxAge, Secure: o.Secure, HttpOnly: o.HttpOnly}
+	if o.MaxAge > 0 {
+		c.Expires = time.Now().Add(time.Duration(o.MaxAge) * time.Second)
+	} else if o.MaxAge < 0 {
+		c.Expires = time.Unix(1, 0)
+	}
+	return c
+}
+
+func (ss *SessionStore) mac(name, id string) string {
+	m := hmac.New(sha256.New, ss.secret)
+	m.Write([]byte(name + "|" + id))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func (ss *SessionStore) sign(name, id string) string {
+	return id + "." + ss.mac(name, id)
+}
+
+func (ss *SessionStore) verify(name, value string) (string, bool) {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return "", false
+	}
+	id := value[:i]
+	return id, hmac.Equal([]byte(value[i+1:]), []byte(ss.mac(name, id)))
+}
+
+// List returns userID's sessions, most recently used first.
+func (ss *SessionStore) List(ctx context.Context, userID int) []LoginSession {
+	rows, err := dbQuery(ctx, db, "sessions.list", `SELECT id, token_hash, user_id, data, user_agent, ip, created_at, last_seen_at FROM sessions WHERE user_id = ? ORDER BY last_seen_at DESC`, userID)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	defer rows.Close()
+	list := make([]LoginSession, 0, 8)
+	ss.Lock()
+	defer ss.Unlock()
+	for rows.Next() {
+		s, err := scanLoginSession(rows)
+		checkErr(err)
+		// The cache has the last use that hasn't been written yet.
+		if c, ok := ss.byHash[s.Hash]; ok && c.LastSeenAt.After(s.LastSeenAt) {
+			s.LastSeenAt, s.IP = c.LastSeenAt, c.IP
+		}
+		list = append(list, *s)
+	}
+	return list
+}
+
+// Revoke deletes userID's session id. It reports whether there was one.
+func (ss *SessionStore) Revoke(ctx context.Context, userID, id int) bool {
+	result, err := dbExec(ctx, db, "sessions.revoke", `DELETE FROM sessions WHERE id = ? AND user_id = ?`, id, userID)
+	checkErr(err)
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false
+	}
+	ss.Lock()
+	for h, s := range ss.byHash {
+		if s.ID == id {
+			delete(ss.byHash, h)
+		}
+	}
+	ss.Unlock()
+	return true
+}
+
+// RevokeUser deletes all of userID's sessions.
+func (ss *SessionStore) RevokeUser(ctx context.Context, userID int) {
+	_, err := dbExec(ctx, db, "sessions.revoke_user", `DELETE FROM sessions WHERE user_id = ?`, userID)
+	checkErr(err)
+	ss.RemoveUser(userID)
+}
+
+func (ss *SessionStore) RemoveUser(userID int) {
+	ss.Lock()
+	for h, s := range ss.byHash {
+		if s.UserID == userID {
+			delete(ss.byHash, h)
+		}
+	}
+	ss.Unlock()
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// currentSessionID returns the sessions row ID of the request's session, or
+// 0 if it hasn't been saved.
+func currentSessionID(w http.ResponseWriter, r *http.Request) int {
+	session := getSession(w, r)
+	if session.ID == "" {
+		return 0
+	}
+	if s := sessionStore.lookup(r.Context(), hashSessionID(session.ID)); s != nil {
+		return s.ID
+	}
+	return 0
+}
+
+func GetSessions(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	render(w, r, http.StatusOK, "sessions.html", &struct {
+		Page
+		Sessions []LoginSession
+		Current  int
+	}{Page{}, sessionStore.List(r.Context(), user.ID), currentSessionID(w, r)})
+	return nil
+}
+
+func PostSessionRevoke(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	id, err := strconv.Atoi(mux.Vars(r)["session_id"])
+	if err != nil {
+		return ErrContentNotFound
+	}
+	current := currentSessionID(w, r)
+	if !sessionStore.Revoke(r.Context(), user.ID, id) {
+		return ErrContentNotFound
+	}
+	if id == current {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return nil
+	}
+	http.Redirect(w, r, "/sessions", http.StatusSeeOther)
+	return nil
+}
+
+// PostSessionRevokeAll logs the user out everywhere, this browser included.
+func PostSessionRevokeAll(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	sessionStore.RevokeUser(r.Context(), user.ID)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	return nil
+}
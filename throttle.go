@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failed logins are counted per client IP and per email over a sliding
+// window of config.LoginWindow. Once either count gets to half its limit,
+// each further attempt is delayed, doubling every failure; at the limit,
+// logins are refused for config.LoginLockout. With config.LoginPersist the
+// failures are also written to login_failures and reloaded at startup.
+//
+// Attempts still being verified count as failures until they are decided,
+// so that guesses sent in parallel can't all get past the check.
+
+var ErrLoginLocked = &HTTPError{Status: http.StatusTooManyRequests, Message: "ログインの失敗が続いたため、しばらくログインできません。時間をおいてからお試しください"}
+
+const maxLoginDelay = 4 * time.Second
+
+type loginAttempts struct {
+	failures    []time.Time // oldest first
+	pending     int         // attempts being verified
+	lockedUntil time.Time
+}
+
+// prune drops failures that have left the window.
+func (a *loginAttempts) prune(now time.Time) {
+	from := now.Add(-time.Duration(config.LoginWindow))
+	i := 0
+	for i < len(a.failures) && !a.failures[i].After(from) {
+		i++
+	}
+	a.failures = a.failures[i:]
+}
+
+func (a *loginAttempts) fail(t time.Time, max int) {
+	a.prune(t)
+	a.failures = append(a.failures, t)
+	if len(a.failures) >= max {
+		a.lockedUntil = t.Add(time.Duration(config.LoginLockout))
+	}
+}
+
+// end removes an attempt that has been decided from pending.
+func (a *loginAttempts) end() {
+	if a.pending > 0 {
+		a.pending--
+	}
+}
+
+// full reports whether failures and pending attempts have reached max.
+func (a *loginAttempts) full(max int) bool {
+	return len(a.failures)+a.pending >= max
+}
+
+// delay is how long to hold the next attempt back, given max.
+func (a *loginAttempts) delay(max int) time.Duration {
+	n := len(a.failures) + a.pending - max/2
+	if n < 0 {
+		return 0
+	}
+	if n > 4 {
+		return maxLoginDelay
+	}
+	d := 250 * time.Millisecond << uint(n)
+	if d > maxLoginDelay {
+		d = maxLoginDelay
+	}
+	return d
+}
+
+type LoginThrottle struct {
+	sync.Mutex
+	byIP    map[string]*loginAttempts
+	byEmail map[string]*loginAttempts
+}
+
+var loginThrottle = LoginThrottle{
+	byIP:    make(map[string]*loginAttempts),
+	byEmail: make(map[string]*loginAttempts),
+}
+
+func (lt *LoginThrottle) Init(ctx context.Context) {
+	byIP := make(map[string]*loginAttempts)
+	byEmail := make(map[string]*loginAttempts)
+	if config.LoginPersist {
+		from := time.Now().Add(-time.Duration(config.LoginWindow))
+		rows, err := dbQuery(ctx, db, "login_failures.init", `SELECT email, ip, cleared, created_at FROM login_failures WHERE created_at > ? ORDER BY id`, from)
+		if err != sql.ErrNoRows {
+			checkErr(err)
+		}
+		for rows.Next() {
+			var email, ip string
+			var cleared bool
+			var t time.Time
+			checkErr(rows.Scan(&email, &ip, &cleared, &t))
+			attemptsOf(byIP, ip).fail(t, config.LoginMaxPerIP)
+			if !cleared {
+				attemptsOf(byEmail, loginKey(email)).fail(t, config.LoginMaxPerEmail)
+			}
+		}
+		rows.Close()
+	}
+	lt.Lock()
+	lt.byIP = byIP
+	lt.byEmail = byEmail
+	lt.Unlock()
+}
+
+// loginKey is the form of email that failures are counted under, so that
+// changing its case or padding it doesn't start a fresh count.
+func loginKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func attemptsOf(m map[string]*loginAttempts, key string) *loginAttempts {
+	a := m[key]
+	if a == nil {
+		a = &loginAttempts{}
+		m[key] = a
+	}
+	return a
+}
+
+func (lt *LoginThrottle) Len() int {
+	lt.Lock()
+	defer lt.Unlock()
+	return len(lt.byIP) + len(lt.byEmail)
+}
+
+// Check returns how long the attempt should be delayed, or, if ip or email
+// is locked out, until when. Unless it is locked out, the attempt is
+// reserved as pending, and the caller must end it with Fail, Succeed or
+// Release.
+func (lt *LoginThrottle) Check(ip, email string, now time.Time) (delay time.Duration, lockedUntil time.Time) {
+	email = loginKey(email)
+	lt.Lock()
+	defer lt.Unlock()
+	for _, k := range []struct {
+		a   *loginAttempts
+		max int
+	}{{lt.byIP[ip], config.LoginMaxPerIP}, {lt.byEmail[email], config.LoginMaxPerEmail}} {
+		if k.a == nil {
+			continue
+		}
+		if k.a.lockedUntil.After(now) {
+			if k.a.lockedUntil.After(lockedUntil) {
+				lockedUntil = k.a.lockedUntil
+			}
+			continue
+		}
+		k.a.prune(now)
+		if k.a.full(k.max) {
+			// The attempts in flight may yet lock it; refuse until they
+			// have had time to be decided.
+			if until := now.Add(maxLoginDelay); until.After(lockedUntil) {
+				lockedUntil = until
+			}
+			continue
+		}
+		if d := k.a.delay(k.max); d > delay {
+			delay = d
+		}
+	}
+	if !lockedUntil.IsZero() {
+		return 0, lockedUntil
+	}
+	attemptsOf(lt.byIP, ip).pending++
+	attemptsOf(lt.byEmail, email).pending++
+	return delay, lockedUntil
+}
+
+// Fail turns a pending attempt into a failure and prunes entries that no
+// longer matter.
+func (lt *LoginThrottle) Fail(ip, email string, now time.Time) {
+	email = loginKey(email)
+	lt.Lock()
+	for _, k := range []struct {
+		a   *loginAttempts
+		max int
+	}{{attemptsOf(lt.byIP, ip), config.LoginMaxPerIP}, {attemptsOf(lt.byEmail, email), config.LoginMaxPerEmail}} {
+		k.a.end()
+		k.a.fail(now, k.max)
+	}
+	lt.prune(now)
+	lt.Unlock()
+}
+
+// Succeed ends a pending attempt and forgets the failures for email. Those
+// from the IP still count, so that logging into one's own account doesn't
+// reset a guessing run.
+func (lt *LoginThrottle) Succeed(ip, email string) {
+	lt.Lock()
+	if a := lt.byIP[ip]; a != nil {
+		a.end()
+	}
+	delete(lt.byEmail, loginKey(email))
+	lt.Unlock()
+}
+
+// Release ends a pending attempt that was abandoned before it was decided.
+func (lt *LoginThrottle) Release(ip, email string, now time.Time) {
+	email = loginKey(email)
+	lt.Lock()
+	for _, a := range []*loginAttempts{lt.byIP[ip], lt.byEmail[email]} {
+		if a != nil {
+			a.end()
+		}
+	}
+	lt.prune(now)
+	lt.Unlock()
+}
+
+// prune drops the entries with nothing left to count. lt must be locked.
+func (lt *LoginThrottle) prune(now time.Time) {
+	for _, m := range []map[string]*loginAttempts{lt.byIP, lt.byEmail} {
+		for k, a := range m {
+			if a.prune(now); len(a.failures) == 0 && a.pending == 0 && !a.lockedUntil.After(now) {
+				delete(m, k)
+			}
+		}
+	}
+}
+
+// throttleLogin holds a login attempt back according to the failures so
+// far, or refuses it with ErrLoginLocked. If it returns nil, the attempt
+// must be ended with loginFailed or loginSucceeded.
+func throttleLogin(w http.ResponseWriter, r *http.Request, email string) error {
+	ip := clientIP(r)
+	delay, lockedUntil := loginThrottle.Check(ip, email, time.Now())
+	if !lockedUntil.IsZero() {
+		slog.WarnContext(r.Context(), "login locked out", "ip", ip, "until", lockedUntil)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(lockedUntil)/time.Second)+1))
+		return ErrLoginLocked
+	}
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			loginThrottle.Release(ip, email, time.Now())
+			return r.Context().Err()
+		}
+	}
+	return nil
+}
+
+// loginFailed records a failed login. userID is 0 for an unknown email.
+func loginFailed(ctx context.Context, ip, email string, userID int) {
+	now := time.Now().Truncate(time.Second)
+	loginThrottle.Fail(ip, email, now)
+	slog.InfoContext(ctx, "login failed", "user_id", userID, "ip", ip)
+	if !config.LoginPersist {
+		return
+	}
+	goAsync(func() {
+		dbExec(context.Background(), db, "login_failures.insert", `INSERT INTO login_failures (email, ip, user_id, created_at) VALUES (?,?,?,?)`,
+			email, ip, sql.NullInt64{Int64: int64(userID), Valid: userID != 0}, now)
+	})
+}
+
+func loginSucceeded(ip, email string) {
+	loginThrottle.Succeed(ip, email)
+	if !config.LoginPersist {
+		return
+	}
+	goAsync(func() {
+		dbExec(context.Background(), db, "login_failures.clear", `UPDATE login_failures SET cleared = 1 WHERE email = ? AND cleared = 0`, email)
+	})
+}
+
+// clientIP is the address of the client. Behind the local reverse proxy,
+// which connects over the unix socket or loopback, it is taken from
+// X-Real-IP or the last X-Forwarded-For hop.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() {
+		return host
+	}
+	if v := strings.TrimSpace(r.Header.Get("X-Real-IP")); v != "" {
+		return v
+	}
+	if v := r.Header.Get("X-Forwarded-For"); v != "" {
+		hops := strings.Split(v, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	return host
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// withLoginConfig runs the test with the default login limits and a fresh
+// throttle, restoring both when it ends.
+func withLoginConfig(t *testing.T) *LoginThrottle {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config = defaultConfig()
+	return &LoginThrottle{byIP: make(map[string]*loginAttempts), byEmail: make(map[string]*loginAttempts)}
+}
+
+func TestLoginAttemptsDelay(t *testing.T) {
+	withLoginConfig(t)
+	tests := []struct {
+		failures, pending int
+		want              time.Duration
+	}{
+		{0, 0, 0},
+		{1, 0, 0},
+		{2, 0, 250 * time.Millisecond},
+		{3, 0, 500 * time.Millisecond},
+		{4, 0, time.Second},
+		{5, 0, 2 * time.Second},
+		{6, 0, maxLoginDelay},
+		{20, 0, maxLoginDelay},
+		// Attempts being verified count as failures.
+		{1, 1, 250 * time.Millisecond},
+		{0, 4, time.Second},
+	}
+	now := time.Now()
+	for _, tt := range tests {
+		a := &loginAttempts{pending: tt.pending}
+		for i := 0; i < tt.failures; i++ {
+			a.failures = append(a.failures, now)
+		}
+		if got := a.delay(5); got != tt.want {
+			t.Errorf("delay with %d failures and %d pending = %v, want %v", tt.failures, tt.pending, got, tt.want)
+		}
+	}
+}
+
+func TestLoginAttemptsLockout(t *testing.T) {
+	withLoginConfig(t)
+	now := time.Now()
+	a := &loginAttempts{}
+	for i := 0; i < 4; i++ {
+		a.fail(now, 5)
+	}
+	if !a.lockedUntil.IsZero() {
+		t.Fatalf("locked after 4 of 5 failures, until %v", a.lockedUntil)
+	}
+	a.fail(now, 5)
+	if want := now.Add(time.Duration(config.LoginLockout)); !a.lockedUntil.Equal(want) {
+		t.Errorf("after 5 failures, locked until %v, want %v", a.lockedUntil, want)
+	}
+
+	// Failures older than the window are forgotten.
+	later := now.Add(time.Duration(config.LoginWindow) + time.Second)
+	a.prune(later)
+	if len(a.failures) != 0 {
+		t.Errorf("%d failures left after the window, want 0", len(a.failures))
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	lt := withLoginConfig(t)
+	now := time.Now()
+	for i := 0; i < config.LoginMaxPerEmail; i++ {
+		if _, locked := lt.Check("192.0.2.1", "Alice@example.com", now); !locked.IsZero() {
+			t.Fatalf("attempt %d locked out, until %v", i+1, locked)
+		}
+		lt.Fail("192.0.2.1", "Alice@example.com", now)
+	}
+	// The email is locked out whatever its case or padding, and from
+	// another IP.
+	if _, locked := lt.Check("192.0.2.2", " alice@EXAMPLE.com", now); locked.IsZero() {
+		t.Error("email not locked out after the maximum of failures")
+	}
+	if _, locked := lt.Check("192.0.2.1", "bob@example.com", now); !locked.IsZero() {
+		t.Errorf("another email from the IP locked out, until %v", locked)
+	}
+	lt.Release("192.0.2.1", "bob@example.com", now)
+	if a := lt.byEmail["bob@example.com"]; a != nil {
+		t.Errorf("released attempt left %+v", a)
+	}
+
+	// Succeed forgets the email's failures but not the IP's.
+	lt.Succeed("192.0.2.1", "ALICE@example.com")
+	if a := lt.byEmail["alice@example.com"]; a != nil {
+		t.Errorf("email failures left after Succeed: %+v", a)
+	}
+	if a := lt.byIP["192.0.2.1"]; a == nil || len(a.failures) != config.LoginMaxPerEmail {
+		t.Errorf("IP failures after Succeed = %+v, want %d", a, config.LoginMaxPerEmail)
+	}
+}
+
+// TestLoginThrottleParallel sends more guesses at once than the limit
+// allows; only as many as the limit may get past Check.
+func TestLoginThrottleParallel(t *testing.T) {
+	lt := withLoginConfig(t)
+	now := time.Now()
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		passed int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, locked := lt.Check("192.0.2.1", "alice@example.com", now); locked.IsZero() {
+				mu.Lock()
+				passed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if passed != config.LoginMaxPerEmail {
+		t.Fatalf("%d parallel attempts got past Check, want %d", passed, config.LoginMaxPerEmail)
+	}
+	for i := 0; i < passed; i++ {
+		lt.Fail("192.0.2.1", "alice@example.com", now)
+	}
+	if a := lt.byEmail["alice@example.com"]; a.pending != 0 || a.lockedUntil.IsZero() {
+		t.Errorf("after the failures, attempts are %+v, want none pending and locked", a)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+)
+
+// APIToken is a personal access token for non-browser clients. Only the
+// SHA-256 of the token is stored, so a leaked table can't be used to
+// authenticate.
+type APIToken struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	Hash       string
+	CreatedAt  time.Time
+	LastUsedAt mysql.NullTime
+}
+
+const (
+	apiTokenPrefix  = "isx_"
+	maxTokenNameLen = 64
+)
+
+// validTokenName reports whether name, already trimmed, can name a token.
+func validTokenName(name string) bool {
+	return name != "" && utf8.RuneCountInString(name) <= maxTokenNameLen
+}
+
+// Scopes a token can be granted. A route registered without a scope can't
+// be used with a token at all.
+const (
+	ScopeEntriesRead    = "entries:read"
+	ScopeEntriesWrite   = "entries:write"
+	ScopeFootprintsRead = "footprints:read"
+	ScopeFriends        = "friends"
+
+	// scopeAny marks routes any valid token may use.
+	scopeAny = "*"
+)
+
+var allScopes = []string{ScopeEntriesRead, ScopeEntriesWrite, ScopeFootprintsRead, ScopeFriends}
+
+var scopeLabels = map[string]string{
+	ScopeEntriesRead:    "日記・コメントの閲覧",
+	ScopeEntriesWrite:   "日記・コメントの投稿",
+	ScopeFootprintsRead: "あしあとの閲覧",
+	ScopeFriends:        "友だちの管理",
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	if scope == scopeAny {
+		return true
+	}
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScopes keeps the known scopes in s, in allScopes order.
+func parseScopes(s []string) []string {
+	scopes := make([]string, 0, len(allScopes))
+	for _, known := range allScopes {
+		for _, v := range s {
+			if v == known {
+				scopes = append(scopes, known)
+				break
+			}
+		}
+	}
+	return scopes
+}
+
+// apiTokenTouchInterval limits how often last_used_at is written for a
+// token in constant use.
+const apiTokenTouchInterval = time.Minute
+
+type APITokenRepo struct {
+	sync.Mutex
+	byHash map[string]APIToken
+}
+
+var apiTokenRepo = APITokenRepo{byHash: make(map[string]APIToken, 1024)}
+
+func (tr *APITokenRepo) Init(ctx context.Context) {
+	rows, err := dbQuery(ctx, db, "api_tokens.init", `SELECT id, user_id, name, scopes, token_hash, created_at, last_used_at FROM api_tokens`)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+	}
+	defer rows.Close()
+	byHash := make(map[string]APIToken, 1024)
+	for rows.Next() {
+		var t APIToken
+		var scopes string
+		checkErr(rows.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.Hash, &t.CreatedAt, &t.LastUsedAt))
+		t.Scopes = parseScopes(strings.Split(scopes, " "))
+		byHash[t.Hash] = t
+	}
+	tr.Lock()
+	tr.byHash = byHash
+	tr.Unlock()
+}
+
+func (tr *APITokenRepo) Insert(t APIToken) {
+	tr.Lock()
+	tr.byHash[t.Hash] = t
+	tr.Unlock()
+}
+
+func (tr *APITokenRepo) Remove(hash string) {
+	tr.Lock()
+	delete(tr.byHash, hash)
+	tr.Unlock()
+}
+
+// Touch records that the token was used at now, and reports whether the
+// last recorded use is old enough that it should be written to the DB.
+func (tr *APITokenRepo) Touch(hash string, now time.Time) bool {
+	tr.Lock()
+	defer tr.Unlock()
+	t, ok := tr.byHash[hash]
+	if !ok || t.LastUsedAt.Valid && now.Sub(t.LastUsedAt.Time) < apiTokenTouchInterval {
+		return false
+	}
+	t.LastUsedAt = mysql.NullTime{Time: now, Valid: true}
+	tr.byHash[hash] = t
+	return true
+}
+
+// List returns userID's tokens, newest first.
+func (tr *APITokenRepo) List(userID int) []APIToken {
+	tr.Lock()
+	tokens := make([]APIToken, 0, 4)
+	for _, t := range tr.byHash {
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	tr.Unlock()
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID > tokens[j].ID })
+	return tokens
+}
+
+func (tr *APITokenRepo) RemoveUser(userID int) {
+	tr.Lock()
+	for h, t := range tr.byHash {
+		if t.UserID == userID {
+			delete(tr.byHash, h)
+		}
+	}
+	tr.Unlock()
+}
+
+// Lookup returns the token whose plain text is token.
+func (tr *APITokenRepo) Lookup(token string) (APIToken, bool) {
+	h := hashAPIToken(token)
+	tr.Lock()
+	t, ok := tr.byHash[h]
+	tr.Unlock()
+	return t, ok
+}
+
+func (tr *APITokenRepo) Len() int {
+	tr.Lock()
+	defer tr.Unlock()
+	return len(tr.byHash)
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueAPIToken creates a token for userID and returns its plain text, which
+// is not kept anywhere.
+func issueAPIToken(ctx context.Context, userID int, name string, scopes []string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + hex.EncodeToString(b)
+	t := APIToken{UserID: userID, Name: name, Scopes: scopes, Hash: hashAPIToken(token), CreatedAt: time.Now().Truncate(time.Second)}
+	result, err := dbExec(ctx, db, "api_tokens.insert", `INSERT INTO api_tokens (user_id, name, scopes, token_hash, created_at) VALUES (?,?,?,?,?)`,
+		t.UserID, t.Name, strings.Join(t.Scopes, " "), t.Hash, t.CreatedAt)
+	if err != nil {
+		return "", err
+	}
+	id, _ := result.LastInsertId()
+	t.ID = int(id)
+	apiTokenRepo.Insert(t)
+	return token, nil
+}
+
+func revokeAPIToken(ctx context.Context, t APIToken) {
+	_, err := dbExec(ctx, db, "api_tokens.delete", `DELETE FROM api_tokens WHERE id = ?`, t.ID)
+	checkErr(err)
+	apiTokenRepo.Remove(t.Hash)
+}
+
+// requestToken returns the token the request is authenticated with, nil if
+// it carries no Authorization header, or ErrUnauthorized if the token is
+// unknown.
+func requestToken(r *http.Request) (*APIToken, error) {
+	st := reqState(r)
+	if st.token != nil {
+		return st.token, nil
+	}
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, nil
+	}
+	t, ok := apiTokenRepo.Lookup(token)
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+	if now := time.Now().Truncate(time.Second); apiTokenRepo.Touch(t.Hash, now) {
+		goAsync(func() {
+			dbExec(context.Background(), db, "api_tokens.touch", `UPDATE api_tokens SET last_used_at = ? WHERE id = ?`, now, t.ID)
+		})
+	}
+	st.token = &t
+	return st.token, nil
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+type tokensPage struct {
+	Page
+	Tokens   []APIToken
+	Scopes   []string
+	NewToken string
+	Message  string
+}
+
+func GetTokens(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	render(w, r, http.StatusOK, "tokens.html", &tokensPage{Tokens: apiTokenRepo.List(user.ID), Scopes: allScopes})
+	return nil
+}
+
+// PostToken issues a token and shows its plain text, this one time only.
+func PostToken(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	r.ParseForm()
+	name := strings.TrimSpace(r.FormValue("name"))
+	scopes := parseScopes(r.Form["scope"])
+	page := tokensPage{Scopes: allScopes}
+	status := http.StatusOK
+	switch {
+	case !validTokenName(name):
+		page.Message = "トークンの名前は1文字以上64文字以内で入力してください"
+		status = http.StatusBadRequest
+	case len(scopes) == 0:
+		page.Message = "許可する操作を1つ以上選んでください"
+		status = http.StatusBadRequest
+	default:
+		token, err := issueAPIToken(r.Context(), user.ID, name, scopes)
+		if err != nil {
+			return Internal(err)
+		}
+		page.NewToken = token
+	}
+	page.Tokens = apiTokenRepo.List(user.ID)
+	render(w, r, status, "tokens.html", &page)
+	return nil
+}
+
+func PostTokenRevoke(w http.ResponseWriter, r *http.Request) error {
+	if !authenticated(w, r) {
+		return nil
+	}
+	user := getCurrentUser(w, r)
+	id, err := strconv.Atoi(mux.Vars(r)["token_id"])
+	if err != nil {
+		return ErrContentNotFound
+	}
+	for _, t := range apiTokenRepo.List(user.ID) {
+		if t.ID == id {
+			revokeAPIToken(r.Context(), t)
+			http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+			return nil
+		}
+	}
+	return ErrContentNotFound
+}